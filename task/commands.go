@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/saran-crayonte/task/database"
+	"github.com/saran-crayonte/task/models"
+	"github.com/saran-crayonte/task/routes"
+)
+
+// runCommand runs an admin command instead of the server and returns the
+// exit status
+func runCommand(args []string) int {
+	database.Connect()
+	switch args[0] {
+	case "migrate":
+		return migrate(args[1:])
+	case "integrity":
+		return checkIntegrity(args[1:])
+	case "promote":
+		return promote(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q, expected migrate, integrity or promote\n", args[0])
+		return 2
+	}
+}
+
+// migrate applies pending migrations (up), undoes the latest ones (down) or
+// lists them all (status)
+func migrate(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: migrate up | down [-steps n] | status")
+		return 2
+	}
+	switch args[0] {
+	case "up":
+		applied, err := database.MigrateUp()
+		for _, migration := range applied {
+			fmt.Printf("Applied %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error migrating up: %v\n", err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Println("Schema is up to date")
+		}
+		return 0
+	case "down":
+		flags := flag.NewFlagSet("migrate down", flag.ContinueOnError)
+		steps := flags.Int("steps", 1, "how many migrations to undo")
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+		undone, err := database.MigrateDown(*steps)
+		for _, migration := range undone {
+			fmt.Printf("Undid %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error migrating down: %v\n", err)
+			return 1
+		}
+		if len(undone) == 0 {
+			fmt.Println("No migrations to undo")
+		}
+		return 0
+	case "status":
+		states, err := database.MigrationStatus()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading migrations: %v\n", err)
+			return 1
+		}
+		for _, state := range states {
+			status := "pending"
+			if state.AppliedAt != nil {
+				status = "applied " + state.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			if state.Unknown {
+				status += ", unknown to this binary"
+			}
+			fmt.Printf("%04d_%s\t%s\n", state.Version, state.Name, status)
+		}
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown migrate command %q, expected up, down or status\n", args[0])
+		return 2
+	}
+}
+
+// checkIntegrity reports rows that reference missing rows. With -repair it
+// fixes them and applies the migrations that they blocked.
+func checkIntegrity(args []string) int {
+	flags := flag.NewFlagSet("integrity", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "delete or unlink the orphaned rows")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	problems, err := routes.CheckIntegrity(database.WithActor(context.Background(), "system"), *repair)
+	if len(problems) == 0 && err == nil {
+		fmt.Println("No orphaned rows found")
+		return 0
+	}
+	for _, problem := range problems {
+		fmt.Printf("%s.%s references missing %s: %d rows %v\n", problem.Table, problem.Column, problem.References, len(problem.IDs), problem.IDs)
+		if problem.Repaired {
+			fmt.Printf("  repaired: %s\n", problem.Repair)
+		} else {
+			fmt.Printf("  -repair: %s\n", problem.Repair)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "integrity check failed, nothing was repaired: %v\n", err)
+		return 1
+	}
+	if !*repair {
+		return 1
+	}
+	return migrate([]string{"up"})
+}
+
+// promote makes a user an admin. Accounts from before roles existed are all
+// members, so this is how an upgraded deployment gets its first admin.
+func promote(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: promote <username>")
+		return 2
+	}
+	tx := database.For(database.WithActor(context.Background(), "system"))
+
+	var existingUser models.User
+	tx.First(&existingUser, "username = ?", args[0])
+	if len(existingUser.Username) == 0 {
+		fmt.Fprintf(os.Stderr, "user %q doesn't exist\n", args[0])
+		return 1
+	}
+	if existingUser.Role == models.RoleAdmin {
+		fmt.Printf("%s is already an admin\n", existingUser.Username)
+		return 0
+	}
+	if err := tx.Model(&existingUser).Update("role", models.RoleAdmin).Error; err != nil {
+		fmt.Fprintf(os.Stderr, "Error promoting %s: %v\n", existingUser.Username, err)
+		return 1
+	}
+	fmt.Printf("%s is now an admin\n", existingUser.Username)
+	if !existingUser.MFAEnabled {
+		fmt.Println("  admins act as members until they enroll in MFA and sign in with it")
+	}
+	return 0
+}
@@ -0,0 +1,292 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/saran-crayonte/task/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Kinds of audit log entries
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// auditedModels are the models whose changes end up in the audit log.
+// Bookkeeping such as sessions, throttles and the activity feed is left out.
+var auditedModels = map[string]bool{
+	"Task":           true,
+	"TaskAssignment": true,
+	"TaskTemplate":   true,
+	"Holiday":        true,
+	"User":           true,
+	"Comment":        true,
+	"Attachment":     true,
+	"TimeEntry":      true,
+	"Team":           true,
+	"TeamMember":     true,
+	"APIKey":         true,
+	"Workspace":      true,
+}
+
+// The values of redactedFields never reach the log, only the fact that they
+// changed. Changes to ignoredFields alone don't produce an entry.
+var (
+	redactedFields = []string{"password"}
+	ignoredFields  = []string{"lastUsedAt"}
+)
+
+type actorKey struct{}
+type requestIDKey struct{}
+
+// WithActor records who is making the changes run with ctx
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom returns the actor set by WithActor
+func ActorFrom(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// WithRequestID ties the changes run with ctx to a request
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// registerAuditLog hooks the audit log into the create, update and delete
+// callbacks. Only writes made through the model API pass through those:
+// Exec and Raw statements are not audited, so changes to audited models must
+// not use them. The migrations and the login throttle's upsert, which do,
+// only touch tables that aren't audited.
+func registerAuditLog(db *gorm.DB) error {
+	callbacks := db.Callback()
+	if err := callbacks.Create().After("gorm:create").Register("audit:create", auditCreate); err != nil {
+		return err
+	}
+	if err := callbacks.Update().Before("gorm:update").After("workspace:update").Register("audit:before_update", captureBefore); err != nil {
+		return err
+	}
+	if err := callbacks.Update().After("gorm:update").Register("audit:update", auditUpdate); err != nil {
+		return err
+	}
+	if err := callbacks.Delete().Before("gorm:delete").After("workspace:delete").Register("audit:before_delete", captureBefore); err != nil {
+		return err
+	}
+	return callbacks.Delete().After("gorm:delete").Register("audit:delete", auditDelete)
+}
+
+func audited(db *gorm.DB) bool {
+	return db.Statement.Schema != nil && auditedModels[db.Statement.Schema.Name]
+}
+
+func auditCreate(db *gorm.DB) {
+	if db.Error != nil || !audited(db) {
+		return
+	}
+	var entries []models.AuditLog
+	eachRow(db.Statement.ReflectValue, func(row reflect.Value) {
+		entries = append(entries, newAuditEntry(db, AuditCreate, row, nil, auditJSON(row)))
+	})
+	writeAudit(db, entries)
+}
+
+// captureBefore loads the rows an update or delete is about to touch
+func captureBefore(db *gorm.DB) {
+	if db.Error != nil || !audited(db) {
+		return
+	}
+	stmt := db.Statement
+	var conds []clause.Expression
+	if where, ok := stmt.Clauses["WHERE"].Expression.(clause.Where); ok {
+		conds = append(conds, where.Exprs...)
+	}
+	if pk := stmt.Schema.PrioritizedPrimaryField; pk != nil && stmt.ReflectValue.Kind() == reflect.Struct {
+		if value, zero := pk.ValueOf(stmt.Context, stmt.ReflectValue); !zero {
+			conds = append(conds, clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: pk.DBName}, Value: value})
+		}
+	}
+	if len(conds) == 0 {
+		return
+	}
+	db.InstanceSet("audit:before", loadRows(db, conds))
+}
+
+func auditUpdate(db *gorm.DB) {
+	before, ok := capturedRows(db)
+	if !ok || before.Len() == 0 {
+		return
+	}
+	pk := db.Statement.Schema.PrioritizedPrimaryField
+	if pk == nil {
+		return
+	}
+	ids := make([]interface{}, 0, before.Len())
+	for i := 0; i < before.Len(); i++ {
+		id, _ := pk.ValueOf(db.Statement.Context, before.Index(i))
+		ids = append(ids, id)
+	}
+	after := loadRows(db, []clause.Expression{
+		clause.IN{Column: clause.Column{Table: clause.CurrentTable, Name: pk.DBName}, Values: ids},
+	})
+	afterByID := map[string]reflect.Value{}
+	for i := 0; i < after.Len(); i++ {
+		id, _ := pk.ValueOf(db.Statement.Context, after.Index(i))
+		afterByID[fmt.Sprint(id)] = after.Index(i)
+	}
+
+	var entries []models.AuditLog
+	for i := 0; i < before.Len(); i++ {
+		row := before.Index(i)
+		id, _ := pk.ValueOf(db.Statement.Context, row)
+		updated, ok := afterByID[fmt.Sprint(id)]
+		if !ok {
+			continue
+		}
+		oldValues, newValues := diff(auditJSON(row), auditJSON(updated))
+		if oldValues == nil {
+			continue
+		}
+		entries = append(entries, newAuditEntry(db, AuditUpdate, updated, oldValues, newValues))
+	}
+	writeAudit(db, entries)
+}
+
+func auditDelete(db *gorm.DB) {
+	before, ok := capturedRows(db)
+	if !ok {
+		return
+	}
+	var entries []models.AuditLog
+	for i := 0; i < before.Len(); i++ {
+		row := before.Index(i)
+		entries = append(entries, newAuditEntry(db, AuditDelete, row, auditJSON(row), nil))
+	}
+	writeAudit(db, entries)
+}
+
+func capturedRows(db *gorm.DB) (reflect.Value, bool) {
+	if db.Error != nil || !audited(db) {
+		return reflect.Value{}, false
+	}
+	rows, ok := db.InstanceGet("audit:before")
+	if !ok {
+		return reflect.Value{}, false
+	}
+	return rows.(reflect.Value), true
+}
+
+// loadRows reads the rows of the statement's model matching conds, in the
+// same transaction and workspace as the statement
+func loadRows(db *gorm.DB, conds []clause.Expression) reflect.Value {
+	modelType := db.Statement.Schema.ModelType
+	rows := reflect.New(reflect.SliceOf(modelType))
+	tx := db.Session(&gorm.Session{NewDB: true}).Model(reflect.New(modelType).Interface())
+	if db.Statement.Unscoped {
+		tx = tx.Unscoped()
+	}
+	tx.Statement.AddClause(clause.Where{Exprs: conds})
+	tx.Find(rows.Interface())
+	return rows.Elem()
+}
+
+func newAuditEntry(db *gorm.DB, action string, row reflect.Value, before, after map[string]interface{}) models.AuditLog {
+	ctx := db.Statement.Context
+	entry := models.AuditLog{
+		Action:     action,
+		EntityType: db.Statement.Schema.Name,
+		Before:     marshalAudit(before),
+		After:      marshalAudit(after),
+	}
+	entry.Actor, _ = ctx.Value(actorKey{}).(string)
+	entry.RequestID, _ = ctx.Value(requestIDKey{}).(string)
+	if pk := db.Statement.Schema.PrioritizedPrimaryField; pk != nil {
+		id, _ := pk.ValueOf(ctx, row)
+		entry.EntityID = fmt.Sprint(id)
+	}
+	entry.WorkspaceID = models.DefaultWorkspaceID
+	if workspace, ok := row.Interface().(models.Workspace); ok {
+		entry.WorkspaceID = workspace.ID
+	} else if field := db.Statement.Schema.LookUpField("WorkspaceID"); field != nil {
+		if id, zero := field.ValueOf(ctx, row); !zero {
+			entry.WorkspaceID = id.(uint)
+		}
+	}
+	return entry
+}
+
+func writeAudit(db *gorm.DB, entries []models.AuditLog) {
+	if len(entries) == 0 {
+		return
+	}
+	db.AddError(db.Session(&gorm.Session{NewDB: true}).Create(&entries).Error)
+}
+
+// auditJSON is the row as the API would show it
+func auditJSON(row reflect.Value) map[string]interface{} {
+	data, err := json.Marshal(row.Interface())
+	if err != nil {
+		return nil
+	}
+	var values map[string]interface{}
+	json.Unmarshal(data, &values)
+	return values
+}
+
+// diff returns the old and new values of the fields that changed, or nil if
+// nothing but ignored fields did
+func diff(before, after map[string]interface{}) (map[string]interface{}, map[string]interface{}) {
+	oldValues := map[string]interface{}{}
+	newValues := map[string]interface{}{}
+	for key, value := range after {
+		if !reflect.DeepEqual(before[key], value) {
+			oldValues[key] = before[key]
+			newValues[key] = value
+		}
+	}
+	for key, value := range before {
+		if _, ok := after[key]; !ok {
+			oldValues[key] = value
+			newValues[key] = nil
+		}
+	}
+	for _, field := range ignoredFields {
+		delete(oldValues, field)
+		delete(newValues, field)
+	}
+	if len(newValues) == 0 {
+		return nil, nil
+	}
+	return oldValues, newValues
+}
+
+func marshalAudit(values map[string]interface{}) models.RawJSON {
+	if values == nil {
+		return nil
+	}
+	for _, field := range redactedFields {
+		if _, ok := values[field]; ok {
+			values[field] = "[redacted]"
+		}
+	}
+	data, _ := json.Marshal(values)
+	return data
+}
+
+func eachRow(rv reflect.Value, fn func(reflect.Value)) {
+	switch rv = reflect.Indirect(rv); rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			fn(reflect.Indirect(rv.Index(i)))
+		}
+	case reflect.Struct:
+		fn(rv)
+	}
+}
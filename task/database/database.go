@@ -1,25 +1,50 @@
 package database
 
 import (
+	"fmt"
 	"log"
 
-	"github.com/saran-crayonte/task/models"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
 var DB *gorm.DB
 
+// DSN is the connection string of the database
+const DSN = "host=localhost user=postgres password=1234 dbname=sample port=5432 sslmode=disable"
+
+// ConnectDB connects to the database and refuses to go on unless its schema
+// is fully migrated
 func ConnectDB() {
-	conn := "host=localhost user=postgres password=1234 dbname=sample port=5432 sslmode=disable"
-	db, err := gorm.Open(postgres.Open(conn), &gorm.Config{})
+	Connect()
+	if err := CheckSchema(); err != nil {
+		log.Fatalf("Database schema is not up to date: %v", err)
+	}
+}
+
+// Connect connects to the database whatever state its schema is in. Only
+// the migration and maintenance commands should use it directly.
+func Connect() {
+	db, err := Open(DSN)
 	if err != nil {
 		log.Fatalf("Error connecting to database: %v", err)
 		return
 	}
 	DB = db
-	DB.AutoMigrate(&models.Task{})
-	DB.AutoMigrate(&models.User{})
-	DB.AutoMigrate(&models.Holiday{})
-	DB.AutoMigrate(&models.TaskAssignment{})
+}
+
+// Open connects to the database at dsn with the workspace scope and the
+// audit log in place
+func Open(dsn string) (*gorm.DB, error) {
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
+	if err != nil {
+		return nil, err
+	}
+	if err := registerWorkspaceScope(db); err != nil {
+		return nil, fmt.Errorf("registering workspace scope: %w", err)
+	}
+	if err := registerAuditLog(db); err != nil {
+		return nil, fmt.Errorf("registering audit log: %w", err)
+	}
+	return db, nil
 }
@@ -0,0 +1,248 @@
+package database
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/saran-crayonte/task/models"
+	"gorm.io/gorm"
+)
+
+// The schema is defined by the migrations, not by the model tags. A change
+// to a model needs a new pair of files in migrations/, numbered after the
+// last one: <version>_<name>.up.sql applies it and <version>_<name>.down.sql
+// undoes it.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// migrationLock keeps two processes from migrating at the same time
+const migrationLock = 7263110
+
+// Migration is one versioned step of the schema
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationState is a migration together with when it was applied, if it
+// was. Unknown is set for versions the database has but this binary lacks.
+type MigrationState struct {
+	Migration
+	AppliedAt *time.Time
+	Unknown   bool
+}
+
+// Migrations returns the embedded migrations ordered by version
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration %s: name must look like 0001_name.up.sql", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		sql, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		migration := byVersion[version]
+		if migration == nil {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names, %s and %s", version, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = string(sql)
+		} else {
+			migration.Down = string(sql)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// MigrationStatus lists every migration known to the binary or the
+// database in version order
+func MigrationStatus() ([]MigrationState, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(DB)
+	if err != nil {
+		return nil, err
+	}
+
+	var states []MigrationState
+	for _, migration := range migrations {
+		state := MigrationState{Migration: migration}
+		if record, ok := applied[migration.Version]; ok {
+			state.AppliedAt = &record.AppliedAt
+			delete(applied, migration.Version)
+		}
+		states = append(states, state)
+	}
+	for _, record := range applied {
+		appliedAt := record.AppliedAt
+		states = append(states, MigrationState{
+			Migration: Migration{Version: record.Version, Name: record.Name},
+			AppliedAt: &appliedAt,
+			Unknown:   true,
+		})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Version < states[j].Version })
+	return states, nil
+}
+
+// CheckSchema returns an error unless every migration has been applied and
+// the database has none this binary doesn't know about
+func CheckSchema() error {
+	states, err := MigrationStatus()
+	if err != nil {
+		return err
+	}
+	for _, state := range states {
+		if state.Unknown {
+			return fmt.Errorf("database has migration %d_%s, which this binary doesn't know, it was migrated by a newer version", state.Version, state.Name)
+		}
+		if state.AppliedAt == nil {
+			return fmt.Errorf("migration %d_%s has not been applied, run the migrate up command", state.Version, state.Name)
+		}
+	}
+	return nil
+}
+
+// MigrateUp applies the pending migrations in order, each in its own
+// transaction, and returns the ones it applied
+func MigrateUp() ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for _, migration := range migrations {
+		applied := false
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			records, err := lockMigrations(tx)
+			if err != nil {
+				return err
+			}
+			if _, ok := records[migration.Version]; ok {
+				return nil
+			}
+			if err := tx.Exec(migration.Up).Error; err != nil {
+				return err
+			}
+			applied = true
+			return tx.Create(&models.SchemaMigration{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		if applied {
+			done = append(done, migration)
+		}
+	}
+	return done, nil
+}
+
+// MigrateDown undoes the last steps applied migrations, newest first, and
+// returns the ones it undid
+func MigrateDown(steps int) ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		migration := migrations[i]
+		undone := false
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			records, err := lockMigrations(tx)
+			if err != nil {
+				return err
+			}
+			for version, record := range records {
+				if version > migration.Version {
+					return fmt.Errorf("database has migration %d_%s, which this binary can't undo", version, record.Name)
+				}
+			}
+			if _, ok := records[migration.Version]; !ok {
+				return nil
+			}
+			if err := tx.Exec(migration.Down).Error; err != nil {
+				return err
+			}
+			undone = true
+			return tx.Delete(&models.SchemaMigration{}, migration.Version).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		if undone {
+			done = append(done, migration)
+		}
+	}
+	return done, nil
+}
+
+// lockMigrations waits for any other migrating process to finish and
+// returns the migrations applied so far, creating the table that records
+// them on first use. The lock lasts until tx ends.
+func lockMigrations(tx *gorm.DB) (map[int]models.SchemaMigration, error) {
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLock).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+	version bigint PRIMARY KEY,
+	name text NOT NULL,
+	applied_at timestamptz NOT NULL
+)`).Error; err != nil {
+		return nil, err
+	}
+	return appliedMigrations(tx)
+}
+
+// appliedMigrations only reads: a database that was never migrated has no
+// table of applied migrations, and everything is pending
+func appliedMigrations(tx *gorm.DB) (map[int]models.SchemaMigration, error) {
+	applied := map[int]models.SchemaMigration{}
+	if !tx.Migrator().HasTable(&models.SchemaMigration{}) {
+		return applied, nil
+	}
+	var records []models.SchemaMigration
+	if err := tx.Find(&records).Error; err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
@@ -0,0 +1,5 @@
+-- drops everything, data included
+DROP TABLE IF EXISTS "task_assignments" CASCADE;
+DROP TABLE IF EXISTS "holidays" CASCADE;
+DROP TABLE IF EXISTS "users" CASCADE;
+DROP TABLE IF EXISTS "tasks" CASCADE;
@@ -0,0 +1,36 @@
+-- The schema of the first release, which AutoMigrate created on startup.
+-- Databases from that release already have these tables and adopt them as
+-- they are; everything added since comes in the later migrations.
+
+CREATE TABLE IF NOT EXISTS "tasks" (
+	"id" bigserial,
+	"title" text NOT NULL,
+	"status" text NOT NULL,
+	"estimated_hours" bigint NOT NULL,
+	PRIMARY KEY ("id")
+);
+
+CREATE TABLE IF NOT EXISTS "users" (
+	"username" text NOT NULL,
+	"name" text NOT NULL,
+	"email" text NOT NULL,
+	"password" text NOT NULL,
+	PRIMARY KEY ("username")
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_users_username" ON "users" ("username");
+
+CREATE TABLE IF NOT EXISTS "holidays" (
+	"id" bigserial,
+	"holiday_name" text NOT NULL,
+	"holiday_date" text NOT NULL,
+	PRIMARY KEY ("id")
+);
+
+CREATE TABLE IF NOT EXISTS "task_assignments" (
+	"id" bigserial,
+	"username" text NOT NULL,
+	"task_id" bigint NOT NULL,
+	"start_date" text NOT NULL,
+	"end_date" text,
+	PRIMARY KEY ("id")
+);
@@ -0,0 +1,14 @@
+DROP TABLE IF EXISTS "time_entries" CASCADE;
+DROP TABLE IF EXISTS "attachments" CASCADE;
+DROP TABLE IF EXISTS "task_activities" CASCADE;
+DROP TABLE IF EXISTS "comments" CASCADE;
+
+DROP INDEX IF EXISTS "idx_task_assignments_username";
+DROP INDEX IF EXISTS "idx_task_assignments_task_id";
+
+ALTER TABLE "tasks"
+	DROP COLUMN IF EXISTS "due_date",
+	DROP COLUMN IF EXISTS "template_id",
+	DROP COLUMN IF EXISTS "parent_id";
+
+DROP TABLE IF EXISTS "task_templates" CASCADE;
@@ -0,0 +1,81 @@
+-- Subtasks, recurring templates, comments, the activity feed, attachments
+-- and time tracking
+
+CREATE TABLE IF NOT EXISTS "task_templates" (
+	"id" bigserial,
+	"title" text NOT NULL,
+	"estimated_hours" bigint NOT NULL,
+	"frequency" text NOT NULL,
+	"interval" bigint NOT NULL DEFAULT 1,
+	"by_day" text,
+	"by_week_no" bigint,
+	"start_date" text NOT NULL,
+	"until" text,
+	"assignees" text,
+	"next_assignee" bigint,
+	"generated_through" text,
+	PRIMARY KEY ("id")
+);
+
+ALTER TABLE "tasks"
+	ADD COLUMN IF NOT EXISTS "parent_id" bigint,
+	ADD COLUMN IF NOT EXISTS "template_id" bigint,
+	ADD COLUMN IF NOT EXISTS "due_date" text;
+CREATE INDEX IF NOT EXISTS "idx_tasks_parent_id" ON "tasks" ("parent_id");
+CREATE INDEX IF NOT EXISTS "idx_tasks_template_id" ON "tasks" ("template_id");
+
+CREATE INDEX IF NOT EXISTS "idx_task_assignments_task_id" ON "task_assignments" ("task_id");
+CREATE INDEX IF NOT EXISTS "idx_task_assignments_username" ON "task_assignments" ("username");
+
+CREATE TABLE IF NOT EXISTS "comments" (
+	"id" bigserial,
+	"task_id" bigint NOT NULL,
+	"author" text NOT NULL,
+	"body" text NOT NULL,
+	"created_at" timestamptz,
+	"updated_at" timestamptz,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_comments_task_id" ON "comments" ("task_id");
+
+CREATE TABLE IF NOT EXISTS "task_activities" (
+	"id" bigserial,
+	"task_id" bigint NOT NULL,
+	"actor" text,
+	"kind" text NOT NULL,
+	"from" text,
+	"to" text,
+	"created_at" timestamptz,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_task_activities_task_id" ON "task_activities" ("task_id");
+
+CREATE TABLE IF NOT EXISTS "attachments" (
+	"id" bigserial,
+	"task_id" bigint NOT NULL,
+	"filename" text NOT NULL,
+	"content_type" text NOT NULL,
+	"size" bigint NOT NULL,
+	"checksum" text NOT NULL,
+	"storage_key" text NOT NULL,
+	"uploaded_by" text,
+	"created_at" timestamptz,
+	PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_attachments_storage_key" ON "attachments" ("storage_key");
+CREATE INDEX IF NOT EXISTS "idx_attachments_task_id" ON "attachments" ("task_id");
+
+CREATE TABLE IF NOT EXISTS "time_entries" (
+	"id" bigserial,
+	"task_assignment_id" bigint NOT NULL,
+	"username" text NOT NULL,
+	"date" text NOT NULL,
+	"hours" decimal NOT NULL,
+	"note" text,
+	"started_at" timestamptz,
+	"ended_at" timestamptz,
+	"created_at" timestamptz,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_time_entries_username" ON "time_entries" ("username");
+CREATE INDEX IF NOT EXISTS "idx_time_entries_task_assignment_id" ON "time_entries" ("task_assignment_id");
@@ -0,0 +1,24 @@
+DROP TABLE IF EXISTS "team_members" CASCADE;
+DROP TABLE IF EXISTS "teams" CASCADE;
+DROP TABLE IF EXISTS "email_verifications" CASCADE;
+DROP TABLE IF EXISTS "o_id_c_login_states" CASCADE;
+DROP TABLE IF EXISTS "api_keys" CASCADE;
+DROP TABLE IF EXISTS "recovery_codes" CASCADE;
+DROP TABLE IF EXISTS "login_throttles" CASCADE;
+DROP TABLE IF EXISTS "password_resets" CASCADE;
+DROP TABLE IF EXISTS "refresh_tokens" CASCADE;
+
+ALTER TABLE "task_assignments" DROP COLUMN IF EXISTS "needs_reassignment";
+
+DROP INDEX IF EXISTS "idx_users_email";
+DROP INDEX IF EXISTS "idx_users_oidc";
+ALTER TABLE "users"
+	DROP COLUMN IF EXISTS "o_id_c_subject",
+	DROP COLUMN IF EXISTS "o_id_c_issuer",
+	DROP COLUMN IF EXISTS "mfa_last_step",
+	DROP COLUMN IF EXISTS "mfa_enabled",
+	DROP COLUMN IF EXISTS "mfa_secret",
+	DROP COLUMN IF EXISTS "deactivated_at",
+	DROP COLUMN IF EXISTS "active",
+	DROP COLUMN IF EXISTS "email_verified",
+	DROP COLUMN IF EXISTS "role";
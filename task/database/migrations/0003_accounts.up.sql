@@ -0,0 +1,119 @@
+-- Roles, email verification, deactivation, two-factor and single sign-on on
+-- users, the tables behind sessions and logins, and teams. Users from
+-- before this migration become unverified members.
+
+ALTER TABLE "users"
+	ADD COLUMN IF NOT EXISTS "role" text NOT NULL DEFAULT 'member',
+	ADD COLUMN IF NOT EXISTS "email_verified" boolean NOT NULL DEFAULT false,
+	ADD COLUMN IF NOT EXISTS "active" boolean NOT NULL DEFAULT true,
+	ADD COLUMN IF NOT EXISTS "deactivated_at" timestamptz,
+	ADD COLUMN IF NOT EXISTS "mfa_secret" text,
+	ADD COLUMN IF NOT EXISTS "mfa_enabled" boolean NOT NULL DEFAULT false,
+	ADD COLUMN IF NOT EXISTS "mfa_last_step" bigint,
+	ADD COLUMN IF NOT EXISTS "o_id_c_issuer" text,
+	ADD COLUMN IF NOT EXISTS "o_id_c_subject" text;
+CREATE INDEX IF NOT EXISTS "idx_users_oidc" ON "users" ("o_id_c_issuer","o_id_c_subject");
+CREATE INDEX IF NOT EXISTS "idx_users_email" ON "users" ("email");
+
+ALTER TABLE "task_assignments"
+	ADD COLUMN IF NOT EXISTS "needs_reassignment" boolean NOT NULL DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS "refresh_tokens" (
+	"id" bigserial,
+	"username" text NOT NULL,
+	"family_id" text NOT NULL,
+	"token_hash" text NOT NULL,
+	"expires_at" timestamptz NOT NULL,
+	"revoked_at" timestamptz,
+	"replaced_by" bigint,
+	"created_at" timestamptz,
+	PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_refresh_tokens_token_hash" ON "refresh_tokens" ("token_hash");
+CREATE INDEX IF NOT EXISTS "idx_refresh_tokens_family_id" ON "refresh_tokens" ("family_id");
+CREATE INDEX IF NOT EXISTS "idx_refresh_tokens_username" ON "refresh_tokens" ("username");
+
+CREATE TABLE IF NOT EXISTS "password_resets" (
+	"id" bigserial,
+	"username" text NOT NULL,
+	"token_hash" text NOT NULL,
+	"expires_at" timestamptz NOT NULL,
+	"used_at" timestamptz,
+	"created_at" timestamptz,
+	PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_password_resets_token_hash" ON "password_resets" ("token_hash");
+CREATE INDEX IF NOT EXISTS "idx_password_resets_username" ON "password_resets" ("username");
+
+CREATE TABLE IF NOT EXISTS "login_throttles" (
+	"key" text,
+	"failures" bigint NOT NULL,
+	"last_failure_at" timestamptz,
+	"next_attempt_at" timestamptz,
+	"locked_until" timestamptz,
+	PRIMARY KEY ("key")
+);
+
+CREATE TABLE IF NOT EXISTS "recovery_codes" (
+	"id" bigserial,
+	"username" text NOT NULL,
+	"code_hash" text NOT NULL,
+	"used_at" timestamptz,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_recovery_codes_username" ON "recovery_codes" ("username");
+
+CREATE TABLE IF NOT EXISTS "api_keys" (
+	"id" bigserial,
+	"username" text NOT NULL,
+	"name" text NOT NULL,
+	"prefix" text NOT NULL,
+	"key_hash" text NOT NULL,
+	"scope" text NOT NULL,
+	"expires_at" timestamptz,
+	"last_used_at" timestamptz,
+	"revoked_at" timestamptz,
+	"created_at" timestamptz,
+	PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_api_keys_key_hash" ON "api_keys" ("key_hash");
+CREATE INDEX IF NOT EXISTS "idx_api_keys_username" ON "api_keys" ("username");
+
+CREATE TABLE IF NOT EXISTS "o_id_c_login_states" (
+	"state" text,
+	"nonce" text NOT NULL,
+	"verifier" text NOT NULL,
+	"expires_at" timestamptz NOT NULL,
+	PRIMARY KEY ("state")
+);
+
+CREATE TABLE IF NOT EXISTS "email_verifications" (
+	"id" bigserial,
+	"username" text NOT NULL,
+	"email" text NOT NULL,
+	"token_hash" text NOT NULL,
+	"expires_at" timestamptz NOT NULL,
+	"used_at" timestamptz,
+	"created_at" timestamptz,
+	PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_email_verifications_token_hash" ON "email_verifications" ("token_hash");
+CREATE INDEX IF NOT EXISTS "idx_email_verifications_username" ON "email_verifications" ("username");
+
+CREATE TABLE IF NOT EXISTS "teams" (
+	"id" bigserial,
+	"name" text NOT NULL,
+	"parent_id" bigint,
+	"lead" text,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_teams_parent_id" ON "teams" ("parent_id");
+
+CREATE TABLE IF NOT EXISTS "team_members" (
+	"id" bigserial,
+	"team_id" bigint NOT NULL,
+	"username" text NOT NULL,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_team_members_username" ON "team_members" ("username");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_team_members_team_user" ON "team_members" ("team_id","username");
@@ -0,0 +1,16 @@
+DROP FUNCTION IF EXISTS audit_logs_append_only() CASCADE;
+DROP TABLE IF EXISTS "audit_logs" CASCADE;
+
+ALTER TABLE "team_members" DROP COLUMN IF EXISTS "workspace_id";
+ALTER TABLE "teams" DROP COLUMN IF EXISTS "workspace_id";
+ALTER TABLE "time_entries" DROP COLUMN IF EXISTS "workspace_id";
+ALTER TABLE "attachments" DROP COLUMN IF EXISTS "workspace_id";
+ALTER TABLE "task_activities" DROP COLUMN IF EXISTS "workspace_id";
+ALTER TABLE "comments" DROP COLUMN IF EXISTS "workspace_id";
+ALTER TABLE "task_assignments" DROP COLUMN IF EXISTS "workspace_id";
+ALTER TABLE "holidays" DROP COLUMN IF EXISTS "workspace_id";
+ALTER TABLE "users" DROP COLUMN IF EXISTS "workspace_id";
+ALTER TABLE "tasks" DROP COLUMN IF EXISTS "workspace_id";
+ALTER TABLE "task_templates" DROP COLUMN IF EXISTS "workspace_id";
+
+DROP TABLE IF EXISTS "workspaces" CASCADE;
@@ -0,0 +1,62 @@
+-- Workspaces and the audit log. Everything that existed before belongs to
+-- the default workspace, which the column default fills in.
+
+CREATE TABLE IF NOT EXISTS "workspaces" (
+	"id" bigserial,
+	"name" text NOT NULL,
+	"created_at" timestamptz,
+	PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_workspaces_name" ON "workspaces" ("name");
+INSERT INTO workspaces (id, name, created_at) VALUES (1, 'default', now()) ON CONFLICT DO NOTHING;
+SELECT setval(pg_get_serial_sequence('workspaces', 'id'), (SELECT MAX(id) FROM workspaces));
+
+ALTER TABLE "task_templates" ADD COLUMN IF NOT EXISTS "workspace_id" bigint NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS "idx_task_templates_workspace_id" ON "task_templates" ("workspace_id");
+ALTER TABLE "tasks" ADD COLUMN IF NOT EXISTS "workspace_id" bigint NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS "idx_tasks_workspace_id" ON "tasks" ("workspace_id");
+ALTER TABLE "users" ADD COLUMN IF NOT EXISTS "workspace_id" bigint NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS "idx_users_workspace_id" ON "users" ("workspace_id");
+ALTER TABLE "holidays" ADD COLUMN IF NOT EXISTS "workspace_id" bigint NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS "idx_holidays_workspace_id" ON "holidays" ("workspace_id");
+ALTER TABLE "task_assignments" ADD COLUMN IF NOT EXISTS "workspace_id" bigint NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS "idx_task_assignments_workspace_id" ON "task_assignments" ("workspace_id");
+ALTER TABLE "comments" ADD COLUMN IF NOT EXISTS "workspace_id" bigint NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS "idx_comments_workspace_id" ON "comments" ("workspace_id");
+ALTER TABLE "task_activities" ADD COLUMN IF NOT EXISTS "workspace_id" bigint NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS "idx_task_activities_workspace_id" ON "task_activities" ("workspace_id");
+ALTER TABLE "attachments" ADD COLUMN IF NOT EXISTS "workspace_id" bigint NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS "idx_attachments_workspace_id" ON "attachments" ("workspace_id");
+ALTER TABLE "time_entries" ADD COLUMN IF NOT EXISTS "workspace_id" bigint NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS "idx_time_entries_workspace_id" ON "time_entries" ("workspace_id");
+ALTER TABLE "teams" ADD COLUMN IF NOT EXISTS "workspace_id" bigint NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS "idx_teams_workspace_id" ON "teams" ("workspace_id");
+ALTER TABLE "team_members" ADD COLUMN IF NOT EXISTS "workspace_id" bigint NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS "idx_team_members_workspace_id" ON "team_members" ("workspace_id");
+
+CREATE TABLE IF NOT EXISTS "audit_logs" (
+	"id" bigserial,
+	"workspace_id" bigint NOT NULL DEFAULT 1,
+	"actor" text,
+	"action" text NOT NULL,
+	"entity_type" text NOT NULL,
+	"entity_id" text NOT NULL,
+	"before" jsonb,
+	"after" jsonb,
+	"request_id" text,
+	"created_at" timestamptz,
+	PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_audit_logs_workspace_id" ON "audit_logs" ("workspace_id");
+CREATE INDEX IF NOT EXISTS "idx_audit_logs_created_at" ON "audit_logs" ("created_at");
+CREATE INDEX IF NOT EXISTS "idx_audit_logs_entity" ON "audit_logs" ("entity_type","entity_id");
+CREATE INDEX IF NOT EXISTS "idx_audit_logs_actor" ON "audit_logs" ("actor");
+
+-- the audit log is append-only, the application never changes an entry
+CREATE OR REPLACE FUNCTION audit_logs_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_logs is append-only';
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS audit_logs_append_only ON audit_logs;
+CREATE TRIGGER audit_logs_append_only BEFORE UPDATE OR DELETE ON audit_logs FOR EACH ROW EXECUTE FUNCTION audit_logs_append_only();
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS "idx_task_assignments_live_task";
+DROP FUNCTION IF EXISTS bump_version() CASCADE;
+
+ALTER TABLE "holidays" DROP COLUMN IF EXISTS "deleted_at", DROP COLUMN IF EXISTS "version";
+ALTER TABLE "task_assignments" DROP COLUMN IF EXISTS "deleted_at", DROP COLUMN IF EXISTS "version";
+ALTER TABLE "tasks" DROP COLUMN IF EXISTS "deleted_at", DROP COLUMN IF EXISTS "version";
@@ -0,0 +1,41 @@
+-- Row versions and soft deletes on tasks, assignments and holidays. Every
+-- existing row starts at version 1 and live.
+
+ALTER TABLE "tasks"
+	ADD COLUMN IF NOT EXISTS "version" bigint NOT NULL DEFAULT 1,
+	ADD COLUMN IF NOT EXISTS "deleted_at" timestamptz;
+CREATE INDEX IF NOT EXISTS "idx_tasks_deleted_at" ON "tasks" ("deleted_at");
+
+ALTER TABLE "task_assignments"
+	ADD COLUMN IF NOT EXISTS "version" bigint NOT NULL DEFAULT 1,
+	ADD COLUMN IF NOT EXISTS "deleted_at" timestamptz;
+CREATE INDEX IF NOT EXISTS "idx_task_assignments_deleted_at" ON "task_assignments" ("deleted_at");
+
+ALTER TABLE "holidays"
+	ADD COLUMN IF NOT EXISTS "version" bigint NOT NULL DEFAULT 1,
+	ADD COLUMN IF NOT EXISTS "deleted_at" timestamptz;
+CREATE INDEX IF NOT EXISTS "idx_holidays_deleted_at" ON "holidays" ("deleted_at");
+
+-- every change to a versioned row bumps its version, whichever query made
+-- it, so a stale version always means someone else wrote in between
+CREATE OR REPLACE FUNCTION bump_version() RETURNS trigger AS $$
+BEGIN
+	NEW.version := OLD.version + 1;
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS tasks_bump_version ON tasks;
+CREATE TRIGGER tasks_bump_version BEFORE UPDATE ON tasks FOR EACH ROW EXECUTE FUNCTION bump_version();
+DROP TRIGGER IF EXISTS task_assignments_bump_version ON task_assignments;
+CREATE TRIGGER task_assignments_bump_version BEFORE UPDATE ON task_assignments FOR EACH ROW EXECUTE FUNCTION bump_version();
+DROP TRIGGER IF EXISTS holidays_bump_version ON holidays;
+CREATE TRIGGER holidays_bump_version BEFORE UPDATE ON holidays FOR EACH ROW EXECUTE FUNCTION bump_version();
+
+-- a task has at most one live assignment. Older data may give a task
+-- several, so all but the newest go to the trash first, where they stay
+-- restorable until they are purged.
+UPDATE "task_assignments" SET "deleted_at" = now()
+WHERE "deleted_at" IS NULL AND "id" NOT IN (
+	SELECT MAX("id") FROM "task_assignments" WHERE "deleted_at" IS NULL GROUP BY "task_id"
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_task_assignments_live_task" ON "task_assignments" ("task_id") WHERE deleted_at IS NULL;
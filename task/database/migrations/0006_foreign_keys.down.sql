@@ -0,0 +1,10 @@
+ALTER TABLE "team_members" DROP CONSTRAINT IF EXISTS "fk_teams_members";
+ALTER TABLE "teams" DROP CONSTRAINT IF EXISTS "fk_teams_children";
+ALTER TABLE "time_entries" DROP CONSTRAINT IF EXISTS "fk_time_entries_task_assignment";
+ALTER TABLE "attachments" DROP CONSTRAINT IF EXISTS "fk_attachments_task";
+ALTER TABLE "task_activities" DROP CONSTRAINT IF EXISTS "fk_task_activities_task";
+ALTER TABLE "comments" DROP CONSTRAINT IF EXISTS "fk_comments_task";
+ALTER TABLE "task_assignments" DROP CONSTRAINT IF EXISTS "fk_users_assignments";
+ALTER TABLE "task_assignments" DROP CONSTRAINT IF EXISTS "fk_task_assignments_task";
+ALTER TABLE "tasks" DROP CONSTRAINT IF EXISTS "fk_tasks_template";
+ALTER TABLE "tasks" DROP CONSTRAINT IF EXISTS "fk_tasks_children";
@@ -0,0 +1,14 @@
+-- Foreign keys between the tables. Data from before them may hold rows
+-- that point at nothing, which makes this migration fail; the integrity
+-- command with -repair removes those rows and then migrates.
+
+ALTER TABLE "tasks" DROP CONSTRAINT IF EXISTS "fk_tasks_children", ADD CONSTRAINT "fk_tasks_children" FOREIGN KEY ("parent_id") REFERENCES "tasks"("id") ON DELETE SET NULL ON UPDATE CASCADE;
+ALTER TABLE "tasks" DROP CONSTRAINT IF EXISTS "fk_tasks_template", ADD CONSTRAINT "fk_tasks_template" FOREIGN KEY ("template_id") REFERENCES "task_templates"("id") ON DELETE SET NULL ON UPDATE CASCADE;
+ALTER TABLE "task_assignments" DROP CONSTRAINT IF EXISTS "fk_task_assignments_task", ADD CONSTRAINT "fk_task_assignments_task" FOREIGN KEY ("task_id") REFERENCES "tasks"("id") ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE "task_assignments" DROP CONSTRAINT IF EXISTS "fk_users_assignments", ADD CONSTRAINT "fk_users_assignments" FOREIGN KEY ("username") REFERENCES "users"("username") ON DELETE RESTRICT ON UPDATE CASCADE;
+ALTER TABLE "comments" DROP CONSTRAINT IF EXISTS "fk_comments_task", ADD CONSTRAINT "fk_comments_task" FOREIGN KEY ("task_id") REFERENCES "tasks"("id") ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE "task_activities" DROP CONSTRAINT IF EXISTS "fk_task_activities_task", ADD CONSTRAINT "fk_task_activities_task" FOREIGN KEY ("task_id") REFERENCES "tasks"("id") ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE "attachments" DROP CONSTRAINT IF EXISTS "fk_attachments_task", ADD CONSTRAINT "fk_attachments_task" FOREIGN KEY ("task_id") REFERENCES "tasks"("id") ON DELETE RESTRICT ON UPDATE CASCADE;
+ALTER TABLE "time_entries" DROP CONSTRAINT IF EXISTS "fk_time_entries_task_assignment", ADD CONSTRAINT "fk_time_entries_task_assignment" FOREIGN KEY ("task_assignment_id") REFERENCES "task_assignments"("id") ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE "teams" DROP CONSTRAINT IF EXISTS "fk_teams_children", ADD CONSTRAINT "fk_teams_children" FOREIGN KEY ("parent_id") REFERENCES "teams"("id");
+ALTER TABLE "team_members" DROP CONSTRAINT IF EXISTS "fk_teams_members", ADD CONSTRAINT "fk_teams_members" FOREIGN KEY ("team_id") REFERENCES "teams"("id");
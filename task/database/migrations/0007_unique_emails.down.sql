@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS "idx_users_email";
+CREATE INDEX "idx_users_email" ON "users" ("email");
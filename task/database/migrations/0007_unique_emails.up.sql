@@ -0,0 +1,17 @@
+-- No two accounts may share an email address, whatever its case. Accounts
+-- without an address are left out.
+
+DO $$
+DECLARE
+	duplicates text;
+BEGIN
+	SELECT string_agg(email, ', ') INTO duplicates FROM (
+		SELECT LOWER(email) AS email FROM users WHERE email <> '' GROUP BY LOWER(email) HAVING COUNT(*) > 1
+	) AS shared;
+	IF duplicates IS NOT NULL THEN
+		RAISE EXCEPTION 'several users share the email addresses %, change all but one of each before migrating', duplicates;
+	END IF;
+END $$;
+
+DROP INDEX IF EXISTS "idx_users_email";
+CREATE UNIQUE INDEX "idx_users_email" ON "users" (LOWER("email")) WHERE "email" <> '';
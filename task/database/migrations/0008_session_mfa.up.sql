@@ -0,0 +1,3 @@
+-- Sessions remember whether they were opened with a second factor. Sessions
+-- from before can't tell, so they count as opened without one.
+ALTER TABLE "refresh_tokens" ADD COLUMN IF NOT EXISTS "mfa_verified" boolean NOT NULL DEFAULT false;
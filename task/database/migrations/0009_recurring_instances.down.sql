@@ -0,0 +1 @@
+DROP INDEX IF EXISTS "idx_tasks_template_due_date";
@@ -0,0 +1,10 @@
+-- A template has at most one instance per due date, trashed ones included,
+-- so two generators running at once can't both create it. Older data may
+-- have several, so all but the oldest of each are detached from their
+-- template first and stay around as plain tasks.
+
+UPDATE "tasks" SET "template_id" = NULL
+WHERE "template_id" IS NOT NULL AND "id" NOT IN (
+	SELECT MIN("id") FROM "tasks" WHERE "template_id" IS NOT NULL GROUP BY "template_id", "due_date"
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_tasks_template_due_date" ON "tasks" ("template_id", "due_date") WHERE template_id IS NOT NULL;
@@ -0,0 +1,94 @@
+package database
+
+import (
+	"context"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type workspaceKey struct{}
+
+// WithWorkspace returns a context that confines every query run with it to
+// the given workspace
+func WithWorkspace(ctx context.Context, workspaceID uint) context.Context {
+	return context.WithValue(ctx, workspaceKey{}, workspaceID)
+}
+
+// WorkspaceFrom returns the workspace set by WithWorkspace
+func WorkspaceFrom(ctx context.Context) (uint, bool) {
+	id, ok := ctx.Value(workspaceKey{}).(uint)
+	return id, ok && id != 0
+}
+
+// For returns a session whose queries are confined to the workspace carried
+// by ctx. Without one it behaves like DB.
+func For(ctx context.Context) *gorm.DB {
+	return DB.WithContext(ctx)
+}
+
+// registerWorkspaceScope adds callbacks that filter every query, update and
+// delete on a model with a WorkspaceID field to the context's workspace, and
+// stamp that workspace on created rows
+func registerWorkspaceScope(db *gorm.DB) error {
+	callbacks := db.Callback()
+	if err := callbacks.Query().Before("gorm:query").Register("workspace:query", restrictToWorkspace); err != nil {
+		return err
+	}
+	if err := callbacks.Row().Before("gorm:row").Register("workspace:row", restrictToWorkspace); err != nil {
+		return err
+	}
+	if err := callbacks.Update().Before("gorm:update").Register("workspace:update", restrictUpdate); err != nil {
+		return err
+	}
+	if err := callbacks.Delete().Before("gorm:delete").Register("workspace:delete", restrictToWorkspace); err != nil {
+		return err
+	}
+	return callbacks.Create().Before("gorm:create").Register("workspace:create", stampWorkspace)
+}
+
+func workspaceField(db *gorm.DB) (uint, bool) {
+	id, ok := WorkspaceFrom(db.Statement.Context)
+	if !ok || db.Statement.Schema == nil {
+		return 0, false
+	}
+	return id, db.Statement.Schema.LookUpField("WorkspaceID") != nil
+}
+
+func restrictToWorkspace(db *gorm.DB) {
+	id, ok := workspaceField(db)
+	if !ok {
+		return
+	}
+	field := db.Statement.Schema.LookUpField("WorkspaceID")
+	db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: id},
+	}})
+}
+
+// restrictUpdate also keeps rows from being moved to another workspace
+func restrictUpdate(db *gorm.DB) {
+	if _, ok := workspaceField(db); !ok {
+		return
+	}
+	restrictToWorkspace(db)
+	db.Statement.Omits = append(db.Statement.Omits, "WorkspaceID")
+}
+
+func stampWorkspace(db *gorm.DB) {
+	id, ok := workspaceField(db)
+	if !ok {
+		return
+	}
+	field := db.Statement.Schema.LookUpField("WorkspaceID")
+	ctx := db.Statement.Context
+	switch rv := reflect.Indirect(db.Statement.ReflectValue); rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			db.AddError(field.Set(ctx, reflect.Indirect(rv.Index(i)), id))
+		}
+	case reflect.Struct:
+		db.AddError(field.Set(ctx, rv, id))
+	}
+}
@@ -0,0 +1,63 @@
+package mailer
+
+import (
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// Mailer delivers plain text email
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTP sends mail through an SMTP relay. Username and Password are only
+// used when set; net/smtp refuses plain auth over unencrypted connections
+// to anything but localhost.
+type SMTP struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+// NewSMTPFromEnv builds an SMTP mailer from SMTP_ADDR, SMTP_FROM,
+// SMTP_USERNAME and SMTP_PASSWORD. By default it talks to a local relay on
+// port 1025, which is where development SMTP catchers listen.
+func NewSMTPFromEnv() *SMTP {
+	m := &SMTP{
+		Addr:     os.Getenv("SMTP_ADDR"),
+		From:     os.Getenv("SMTP_FROM"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+	}
+	if m.Addr == "" {
+		m.Addr = "localhost:1025"
+	}
+	if m.From == "" {
+		m.From = "no-reply@localhost"
+	}
+	return m
+}
+
+func (m *SMTP) Send(to, subject, body string) error {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return fmt.Errorf("mailer: header contains a line break")
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, _ := strings.Cut(m.Addr, ":")
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	msg := "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		strings.ReplaceAll(body, "\n", "\r\n")
+	return smtp.SendMail(m.Addr, auth, m.From, []string{to}, []byte(msg))
+}
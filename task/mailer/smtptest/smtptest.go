@@ -0,0 +1,109 @@
+// Package smtptest provides a minimal in-process SMTP server that records
+// every message it accepts, for testing code that sends mail.
+package smtptest
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+type Message struct {
+	From string
+	To   []string
+	Data string
+}
+
+type Server struct {
+	Addr string
+
+	listener net.Listener
+	mu       sync.Mutex
+	messages []Message
+}
+
+// NewServer starts a server on a random local port. Close it when done.
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{Addr: l.Addr().String(), listener: l}
+	go s.serve()
+	return s, nil
+}
+
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+// Messages returns the messages received so far
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost smtptest")
+
+	var msg Message
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO", "EHLO":
+			tp.PrintfLine("250 localhost")
+		case "MAIL":
+			msg = Message{From: address(arg)}
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			msg.To = append(msg.To, address(arg))
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.Data = string(data)
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			tp.PrintfLine("250 OK")
+		case "RSET", "NOOP":
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+// address strips "FROM:<...>" and "TO:<...>" down to the address
+func address(arg string) string {
+	_, addr, _ := strings.Cut(arg, ":")
+	addr = strings.TrimSpace(addr)
+	if i := strings.Index(addr, ">"); i >= 0 {
+		addr = addr[:i]
+	}
+	return strings.TrimPrefix(addr, "<")
+}
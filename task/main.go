@@ -2,17 +2,81 @@ package main
 
 import (
 	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gofiber/fiber/v3"
 	"github.com/saran-crayonte/task/database"
 	"github.com/saran-crayonte/task/routes"
+	"github.com/saran-crayonte/task/storage"
+	"github.com/saran-crayonte/task/user"
 )
 
 func main() {
-	app := fiber.New()
+	app := fiber.New(fiber.Config{
+		// leave room for the multipart envelope around an attachment
+		BodyLimit: int(routes.MaxAttachmentSize) + 1<<20,
+	})
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
 	database.ConnectDB()
 
+	if err := user.LoadSigningKeys(); err != nil {
+		log.Fatalf("Error loading JWT signing keys: %v", err)
+	}
+	go reloadSigningKeysOnHangup()
+	user.LoadOIDCConfig()
+	if err := user.LoadPasswordPolicy(); err != nil {
+		log.Fatalf("Error loading password policy: %v", err)
+	}
+	if url := os.Getenv("PASSWORD_RESET_URL"); url != "" {
+		user.PasswordResetURL = url
+	}
+	if url := os.Getenv("EMAIL_VERIFICATION_URL"); url != "" {
+		user.EmailVerificationURL = url
+	}
+	if required, err := strconv.ParseBool(os.Getenv("REQUIRE_VERIFIED_EMAIL")); err == nil {
+		user.RequireVerifiedEmail = required
+	}
+	if domains := os.Getenv("DEFAULT_WORKSPACE_DOMAINS"); domains != "" {
+		user.DefaultWorkspaceDomains = strings.Split(domains, ",")
+	}
+
+	if policy := os.Getenv("TASK_DELETE_POLICY"); policy != "" {
+		routes.TaskDeletePolicy = policy
+	}
+	if policy := os.Getenv("TASK_ASSIGNMENT_DELETE_POLICY"); policy != "" {
+		routes.TaskAssignmentDeletePolicy = policy
+	}
+	if retention, err := time.ParseDuration(os.Getenv("TRASH_RETENTION")); err == nil {
+		routes.TrashRetention = retention
+	}
+	if dir := os.Getenv("ATTACHMENT_DIR"); dir != "" {
+		routes.AttachmentStore = storage.NewFileSystem(dir)
+	}
 	routes.SetupRoutes(app)
 
+	go routes.RunRecurringTaskGenerator(time.Hour)
+	go routes.RunTrashPurger(time.Hour)
+
 	log.Fatal(app.Listen(":8080"))
 }
+
+// reloadSigningKeysOnHangup re-reads the JWT key ring on SIGHUP so keys can be
+// rotated without a restart
+func reloadSigningKeysOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if err := user.LoadSigningKeys(); err != nil {
+			log.Println("Error reloading JWT signing keys, keeping the old ones.", err)
+			continue
+		}
+		log.Println("JWT signing keys reloaded.")
+	}
+}
@@ -2,18 +2,51 @@ package main_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gofiber/fiber/v3"
 	"github.com/saran-crayonte/task/database"
+	"github.com/saran-crayonte/task/mailer"
+	"github.com/saran-crayonte/task/mailer/smtptest"
 	"github.com/saran-crayonte/task/models"
 	"github.com/saran-crayonte/task/routes"
+	"github.com/saran-crayonte/task/storage"
+	"github.com/saran-crayonte/task/user"
+	"github.com/saran-crayonte/task/user/oidctest"
 	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
 )
 
+// TestMain brings the test database's schema up to date, since the server
+// refuses to connect to an unmigrated one. The tests log in with a password
+// alone, so admins and managers get their roles without MFA, and register
+// their example.com users in the default workspace.
+func TestMain(m *testing.M) {
+	user.MFARequiredRoles = nil
+	user.DefaultWorkspaceDomains = []string{"example.com"}
+	database.Connect()
+	if _, err := database.MigrateUp(); err != nil {
+		log.Fatalf("Error migrating test database: %v", err)
+	}
+	os.Exit(m.Run())
+}
+
 func TestCreateUser(t *testing.T) {
 	database.ConnectDB()
 	app := fiber.New()
@@ -22,8 +55,8 @@ func TestCreateUser(t *testing.T) {
 	user := models.User{
 		Username: "Test User 5",
 		Name:     "tester4",
-		Email:    "tester4email",
-		Password: "test",
+		Email:    "tester4@example.com",
+		Password: "tester4pass2024",
 	}
 
 	payload, _ := json.Marshal(user)
@@ -36,6 +69,27 @@ func TestCreateUser(t *testing.T) {
 	assert.Equal(t, http.StatusCreated, taskResp.StatusCode)
 }
 
+func TestCreateUserRequiresWorkspaceDomain(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+
+	name := "outsider-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	userReq := httptest.NewRequest(http.MethodPost, "/api/user", bytes.NewReader(mustJSON(models.User{
+		Username: name,
+		Name:     "outsider",
+		Email:    name + "@elsewhere.test",
+		Password: "outsider4pass2024",
+	})))
+	userResp, err := app.Test(userReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, userResp.StatusCode)
+
+	var count int64
+	database.DB.Model(&models.User{}).Where("username = ?", name).Count(&count)
+	assert.Equal(t, int64(0), count)
+}
+
 func TestLogin(t *testing.T) {
 	database.ConnectDB()
 	app := fiber.New()
@@ -53,6 +107,11 @@ func TestLogin(t *testing.T) {
 	assert.Nil(t, err)
 
 	assert.Equal(t, http.StatusAccepted, userResp.StatusCode)
+
+	var body map[string]interface{}
+	json.NewDecoder(userResp.Body).Decode(&body)
+	profile, _ := body["user"].(map[string]interface{})
+	assert.NotContains(t, profile, "password")
 	//token := userResp.Header.Get("token")
 	//assert.NotEmpty(t, token)
 }
@@ -127,3 +186,1004 @@ func TestDeleteTask(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, http.StatusOK, TasksResp.StatusCode)
 }
+
+func TestGetTaskTree(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+
+	token, _ := workspaceAdmin(t, app, "tree")
+	create := func(task models.Task) models.Task {
+		createReq := httptest.NewRequest(http.MethodPost, "/api/v2/task", bytes.NewReader(mustJSON(task)))
+		createReq.Header.Set("Authorization", "Bearer "+token)
+		createResp, err := app.Test(createReq)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusCreated, createResp.StatusCode)
+		var created models.Task
+		json.NewDecoder(createResp.Body).Decode(&created)
+		return created
+	}
+	root := create(models.Task{Title: "Release", Status: "pending", EstimatedHours: 1})
+	build := create(models.Task{Title: "Build", Status: "completed", EstimatedHours: 3, ParentID: &root.ID})
+	create(models.Task{Title: "Compile", Status: "completed", EstimatedHours: 3, ParentID: &build.ID})
+	create(models.Task{Title: "Announce", Status: "pending", EstimatedHours: 2, ParentID: &root.ID})
+
+	treeReq := httptest.NewRequest(http.MethodGet, "/api/v2/task/tree", bytes.NewReader(mustJSON(models.Task{ID: root.ID})))
+	treeReq.Header.Set("Authorization", "Bearer "+token)
+	treeResp, err := app.Test(treeReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, treeResp.StatusCode)
+
+	var tree models.Task
+	json.NewDecoder(treeResp.Body).Decode(&tree)
+	assert.Equal(t, root.ID, tree.ID)
+	assert.Equal(t, 5, tree.EstimatedHours)
+	assert.Equal(t, "inprogress", tree.Status)
+	if assert.Len(t, tree.Children, 2) {
+		assert.Equal(t, "Build", tree.Children[0].Title)
+		assert.Equal(t, 3, tree.Children[0].EstimatedHours)
+		if assert.Len(t, tree.Children[0].Children, 1) {
+			assert.Equal(t, "Compile", tree.Children[0].Children[0].Title)
+		}
+		assert.Equal(t, "Announce", tree.Children[1].Title)
+		assert.Empty(t, tree.Children[1].Children)
+	}
+}
+
+func TestDetachSubtask(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+
+	token, workspaceID := workspaceAdmin(t, app, "detach")
+	tx := database.For(database.WithWorkspace(context.Background(), workspaceID))
+	parent := models.Task{Title: "Parent task", Status: "pending", EstimatedHours: 1}
+	tx.Create(&parent)
+	child := models.Task{Title: "Child task", Status: "completed", EstimatedHours: 3, ParentID: &parent.ID}
+	tx.Create(&child)
+
+	payload := []byte(`{"id": ` + strconv.Itoa(int(child.ID)) + `, "parentId": null, "children": [{"title": "Smuggled task"}]}`)
+	putReq := httptest.NewRequest(http.MethodPut, "/api/v2/task/id", bytes.NewReader(payload))
+	putReq.Header.Set("Authorization", "Bearer "+token)
+	putResp, err := app.Test(putReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, putResp.StatusCode)
+
+	var detached models.Task
+	tx.First(&detached, child.ID)
+	assert.Nil(t, detached.ParentID)
+	assert.Equal(t, "Child task", detached.Title)
+
+	var smuggled int64
+	tx.Model(&models.Task{}).Where("title = ?", "Smuggled task").Count(&smuggled)
+	assert.Equal(t, int64(0), smuggled)
+}
+
+func TestCreateComment(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+
+	token, workspaceID := workspaceAdmin(t, app, "comment")
+	task := models.Task{Title: "Commented task", Status: "pending", EstimatedHours: 2}
+	database.For(database.WithWorkspace(context.Background(), workspaceID)).Create(&task)
+
+	commentReq := httptest.NewRequest(http.MethodPost, "/api/v2/comment", bytes.NewReader(mustJSON(models.Comment{
+		TaskID: task.ID,
+		Body:   "first pass done, needs review",
+	})))
+	commentReq.Header.Set("Authorization", "Bearer "+token)
+	commentResp, err := app.Test(commentReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, commentResp.StatusCode)
+	var comment models.Comment
+	json.NewDecoder(commentResp.Body).Decode(&comment)
+	assert.NotZero(t, comment.ID)
+	assert.Equal(t, task.ID, comment.TaskID)
+	assert.Equal(t, "first pass done, needs review", comment.Body)
+	assert.True(t, strings.HasPrefix(comment.Author, "comment-"))
+
+	listReq := httptest.NewRequest(http.MethodGet, "/api/v2/comment", bytes.NewReader(mustJSON(models.Comment{TaskID: task.ID})))
+	listReq.Header.Set("Authorization", "Bearer "+token)
+	listResp, err := app.Test(listReq)
+	assert.Nil(t, err)
+	var comments []models.Comment
+	json.NewDecoder(listResp.Body).Decode(&comments)
+	if assert.Len(t, comments, 1) {
+		assert.Equal(t, comment.ID, comments[0].ID)
+		assert.Equal(t, comment.Body, comments[0].Body)
+	}
+}
+
+func TestUploadAttachment(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+
+	defer func(store storage.Storage) { routes.AttachmentStore = store }(routes.AttachmentStore)
+	routes.AttachmentStore = storage.NewFileSystem(t.TempDir())
+
+	token, workspaceID := workspaceAdmin(t, app, "attach")
+	task := models.Task{Title: "Task with notes", Status: "pending", EstimatedHours: 2}
+	database.For(database.WithWorkspace(context.Background(), workspaceID)).Create(&task)
+
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	form.WriteField("taskid", strconv.Itoa(int(task.ID)))
+	file, _ := form.CreateFormFile("file", "notes.txt")
+	file.Write([]byte("acceptance criteria"))
+	form.Close()
+
+	uploadReq := httptest.NewRequest(http.MethodPost, "/api/v2/task/attachment", body)
+	uploadReq.Header.Set("Content-Type", form.FormDataContentType())
+	uploadReq.Header.Set("Authorization", "Bearer "+token)
+	uploadResp, err := app.Test(uploadReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, uploadResp.StatusCode)
+	var attachment models.Attachment
+	json.NewDecoder(uploadResp.Body).Decode(&attachment)
+	assert.Equal(t, task.ID, attachment.TaskID)
+	assert.Equal(t, "notes.txt", attachment.Filename)
+	assert.Equal(t, "text/plain; charset=utf-8", attachment.ContentType)
+	assert.Equal(t, int64(len("acceptance criteria")), attachment.Size)
+	checksum := sha256.Sum256([]byte("acceptance criteria"))
+	assert.Equal(t, hex.EncodeToString(checksum[:]), attachment.Checksum)
+
+	var stored models.Attachment
+	database.DB.First(&stored, attachment.ID)
+	contents, err := routes.AttachmentStore.Open(stored.StorageKey)
+	if assert.Nil(t, err) {
+		defer contents.Close()
+		data, _ := io.ReadAll(contents)
+		assert.Equal(t, "acceptance criteria", string(data))
+	}
+}
+
+func TestGetTaskEffort(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+
+	token, workspaceID := workspaceAdmin(t, app, "effort")
+	var admin user.Profile
+	profileReq := httptest.NewRequest(http.MethodGet, "/api/v2/user/profile", nil)
+	profileReq.Header.Set("Authorization", "Bearer "+token)
+	profileResp, err := app.Test(profileReq)
+	assert.Nil(t, err)
+	json.NewDecoder(profileResp.Body).Decode(&admin)
+
+	tx := database.For(database.WithWorkspace(context.Background(), workspaceID))
+	task := models.Task{Title: "Measured task", Status: "inprogress", EstimatedHours: 8}
+	tx.Create(&task)
+	assignment := models.TaskAssignment{Username: admin.Username, TaskID: task.ID, Start_Date: "2024-02-05 9:00 AM", End_Date: "2024-02-06 9:00 AM"}
+	tx.Create(&assignment)
+	tx.Create(&models.TimeEntry{TaskAssignmentID: assignment.ID, Username: admin.Username, Date: "2024-02-05", Hours: 1.5})
+	tx.Create(&models.TimeEntry{TaskAssignmentID: assignment.ID, Username: admin.Username, Date: "2024-02-06", Hours: 2})
+
+	effortReq := httptest.NewRequest(http.MethodGet, "/api/v2/task/effort", bytes.NewReader(mustJSON(models.Task{ID: task.ID})))
+	effortReq.Header.Set("Authorization", "Bearer "+token)
+	effortResp, err := app.Test(effortReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, effortResp.StatusCode)
+	var effort routes.TaskEffort
+	json.NewDecoder(effortResp.Body).Decode(&effort)
+	assert.Equal(t, task.ID, effort.TaskID)
+	assert.Equal(t, 8, effort.EstimatedHours)
+	assert.Equal(t, 3.5, effort.ActualHours)
+	assert.Equal(t, 4.5, effort.RemainingHours)
+}
+
+func TestCreateTaskTemplate(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+
+	token, _ := workspaceAdmin(t, app, "template")
+	templateReq := httptest.NewRequest(http.MethodPost, "/api/v2/taskTemplate", bytes.NewReader(mustJSON(models.TaskTemplate{
+		Title:            "Monthly patching",
+		EstimatedHours:   4,
+		Frequency:        "monthly",
+		ByDay:            "TU",
+		ByWeekNo:         2,
+		StartDate:        "2024-01-01",
+		Assignees:        "Test User 4,Test User 5",
+		NextAssignee:     1,
+		GeneratedThrough: "2030-01-01",
+	})))
+	templateReq.Header.Set("Authorization", "Bearer "+token)
+	templateResp, err := app.Test(templateReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, templateResp.StatusCode)
+	var created models.TaskTemplate
+	json.NewDecoder(templateResp.Body).Decode(&created)
+	assert.NotZero(t, created.ID)
+
+	getReq := httptest.NewRequest(http.MethodGet, "/api/v2/taskTemplate/id", bytes.NewReader(mustJSON(models.TaskTemplate{ID: created.ID})))
+	getReq.Header.Set("Authorization", "Bearer "+token)
+	getResp, err := app.Test(getReq)
+	assert.Nil(t, err)
+	var template models.TaskTemplate
+	json.NewDecoder(getResp.Body).Decode(&template)
+	assert.Equal(t, "Monthly patching", template.Title)
+	assert.Equal(t, 4, template.EstimatedHours)
+	assert.Equal(t, "monthly", template.Frequency)
+	assert.Equal(t, 1, template.Interval)
+	assert.Equal(t, "TU", template.ByDay)
+	assert.Equal(t, 2, template.ByWeekNo)
+	assert.Equal(t, "2024-01-01", template.StartDate)
+	assert.Equal(t, "Test User 4,Test User 5", template.Assignees)
+	// the generator's bookkeeping starts from scratch whatever was sent
+	assert.Equal(t, 0, template.NextAssignee)
+	assert.Equal(t, "", template.GeneratedThrough)
+}
+
+func TestCreateHolidayRequiresAdmin(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+	holiday := models.Holiday{
+		HolidayName: "Pongal",
+		HolidayDate: "2024-01-15",
+	}
+	payload, _ := json.Marshal(holiday)
+	user.LoadSigningKeys()
+	token, _ := user.GenerateToken(models.User{Username: "Test User 4", Role: models.RoleMember})
+	holidayReq := httptest.NewRequest(http.MethodPost, "/api/v2/holiday", bytes.NewReader(payload))
+	holidayReq.Header.Set("token", token)
+	holidayResp, err := app.Test(holidayReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, holidayResp.StatusCode)
+}
+
+func TestRefreshTokenRejectsUnknownToken(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+	payload, _ := json.Marshal(fiber.Map{"refreshToken": "not-a-real-token"})
+	refreshReq := httptest.NewRequest(http.MethodPost, "/api/user/refresh", bytes.NewReader(payload))
+	refreshResp, err := app.Test(refreshReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, refreshResp.StatusCode)
+}
+
+func TestBearerToken(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+	task := models.Task{
+		ID: 1,
+	}
+	payload, _ := json.Marshal(task)
+
+	missingReq := httptest.NewRequest(http.MethodGet, "/api/v2/task/id", bytes.NewReader(payload))
+	missingResp, err := app.Test(missingReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, missingResp.StatusCode)
+	assert.Equal(t, `Bearer realm="task"`, missingResp.Header.Get("WWW-Authenticate"))
+
+	user.LoadSigningKeys()
+	token, _ := user.GenerateToken(models.User{Username: "Test User 4", Role: models.RoleViewer})
+	bearerReq := httptest.NewRequest(http.MethodGet, "/api/v2/task/id", bytes.NewReader(payload))
+	bearerReq.Header.Set("Authorization", "Bearer "+token)
+	bearerResp, err := app.Test(bearerReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, bearerResp.StatusCode)
+}
+
+func TestRequestPasswordReset(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+
+	smtpServer, err := smtptest.NewServer()
+	assert.Nil(t, err)
+	defer smtpServer.Close()
+	user.Mail = &mailer.SMTP{Addr: smtpServer.Addr, From: "no-reply@localhost"}
+
+	payload, _ := json.Marshal(models.User{Username: "Test User 4"})
+	resetReq := httptest.NewRequest(http.MethodPost, "/api/user/password/reset", bytes.NewReader(payload))
+	resetResp, err := app.Test(resetReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusAccepted, resetResp.StatusCode)
+
+	assert.Eventually(t, func() bool { return len(smtpServer.Messages()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.True(t, strings.Contains(smtpServer.Messages()[0].Data, user.PasswordResetURL))
+}
+
+func TestCreateUserRejectsWeakPassword(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+
+	user := models.User{
+		Username: "Test User 6",
+		Name:     "tester6",
+		Email:    "tester6@example.com",
+		Password: "password1",
+	}
+
+	payload, _ := json.Marshal(user)
+
+	userReq := httptest.NewRequest(http.MethodPost, "/api/user", bytes.NewReader(payload))
+	userResp, err := app.Test(userReq)
+
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusBadRequest, userResp.StatusCode)
+}
+
+func TestLoginUniformError(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+
+	for _, username := range []string{"Test User 4", "No Such User"} {
+		payload, _ := json.Marshal(models.User{Username: username, Password: "wrong-password"})
+		userReq := httptest.NewRequest(http.MethodPost, "/api/user/login", bytes.NewReader(payload))
+		userResp, err := app.Test(userReq)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusUnauthorized, userResp.StatusCode)
+
+		var body map[string]interface{}
+		json.NewDecoder(userResp.Body).Decode(&body)
+		assert.Equal(t, "Invalid username or password.", body["msg"])
+	}
+}
+
+func TestConcurrentLoginFailuresAreCounted(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+
+	// no delays, so every attempt gets as far as the password check
+	defer func(free, lockout, ipFree, ipLockout int) {
+		user.UserFreeAttempts, user.UserLockoutAttempts = free, lockout
+		user.IPFreeAttempts, user.IPLockoutAttempts = ipFree, ipLockout
+	}(user.UserFreeAttempts, user.UserLockoutAttempts, user.IPFreeAttempts, user.IPLockoutAttempts)
+	user.UserFreeAttempts, user.UserLockoutAttempts = 100, 20
+	user.IPFreeAttempts, user.IPLockoutAttempts = 1000, 1000
+
+	username := "throttle-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	defer database.DB.Where("key = ? OR key LIKE ?", "user:"+username, "ip:%").Delete(&models.LoginThrottle{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			payload, _ := json.Marshal(models.User{Username: username, Password: "wrong-password"})
+			userReq := httptest.NewRequest(http.MethodPost, "/api/user/login", bytes.NewReader(payload))
+			userResp, err := app.Test(userReq, -1)
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusUnauthorized, userResp.StatusCode)
+		}()
+	}
+	wg.Wait()
+
+	var throttle models.LoginThrottle
+	database.DB.First(&throttle, "key = ?", "user:"+username)
+	assert.Equal(t, 20, throttle.Failures)
+	assert.NotNil(t, throttle.LockedUntil)
+}
+
+func TestLoginMFARejectsInvalidToken(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+	payload, _ := json.Marshal(fiber.Map{"mfaToken": "not-a-real-token", "code": "123456"})
+	mfaReq := httptest.NewRequest(http.MethodPost, "/api/user/login/mfa", bytes.NewReader(payload))
+	mfaResp, err := app.Test(mfaReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, mfaResp.StatusCode)
+}
+
+func TestRevokedOrUnknownAPIKey(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+	task := models.Task{
+		ID: 1,
+	}
+	payload, _ := json.Marshal(task)
+	getTasksReq := httptest.NewRequest(http.MethodGet, "/api/v2/task/id", bytes.NewReader(payload))
+	getTasksReq.Header.Set("X-API-Key", "tsk_unknown")
+	getTasksResp, err := app.Test(getTasksReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, getTasksResp.StatusCode)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+
+	provider, err := oidctest.NewProvider("task-app")
+	assert.Nil(t, err)
+	defer provider.Close()
+	user.OIDC = user.OIDCConfig{
+		Issuer:      provider.URL,
+		ClientID:    "task-app",
+		RedirectURL: "http://localhost/api/user/oidc/callback",
+	}
+	defer func() { user.OIDC = user.OIDCConfig{} }()
+
+	loginReq := httptest.NewRequest(http.MethodGet, "/api/user/oidc/login", nil)
+	loginResp, err := app.Test(loginReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusFound, loginResp.StatusCode)
+
+	// the mock provider signs the user in straight away and redirects back
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	authorizeResp, err := client.Get(loginResp.Header.Get("Location"))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusFound, authorizeResp.StatusCode)
+	callback, err := url.Parse(authorizeResp.Header.Get("Location"))
+	assert.Nil(t, err)
+
+	callbackReq := httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+	callbackResp, err := app.Test(callbackReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusAccepted, callbackResp.StatusCode)
+
+	// the state is single use
+	replayReq := httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+	replayResp, err := app.Test(replayReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, replayResp.StatusCode)
+}
+
+func TestDeactivateUserRequiresAuth(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+	payload, _ := json.Marshal(fiber.Map{"username": "Test User 4"})
+	deactivateReq := httptest.NewRequest(http.MethodPost, "/api/v2/user/deactivate", bytes.NewReader(payload))
+	deactivateResp, err := app.Test(deactivateReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, deactivateResp.StatusCode)
+}
+
+func TestCreateUserRejectsInvalidEmail(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+
+	user := models.User{
+		Username: "Test User 7",
+		Name:     "tester7",
+		Email:    "tester7email",
+		Password: "tester7pass2024",
+	}
+
+	payload, _ := json.Marshal(user)
+
+	userReq := httptest.NewRequest(http.MethodPost, "/api/user", bytes.NewReader(payload))
+	userResp, err := app.Test(userReq)
+
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusBadRequest, userResp.StatusCode)
+}
+
+func TestTeamWorkloadRequiresAuth(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+	payload, _ := json.Marshal(models.Team{ID: 1})
+	workloadReq := httptest.NewRequest(http.MethodGet, "/api/v2/team/workload", bytes.NewReader(payload))
+	workloadResp, err := app.Test(workloadReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, workloadResp.StatusCode)
+}
+
+func TestCrossWorkspaceReadFails(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	login := func(workspace string) (string, uint) {
+		newUser := fiber.Map{
+			"username":  "tenant-" + workspace,
+			"name":      "tenant",
+			"email":     workspace + "@example.com",
+			"password":  "tenant4pass2024",
+			"workspace": workspace,
+		}
+		payload, _ := json.Marshal(newUser)
+		userResp, err := app.Test(httptest.NewRequest(http.MethodPost, "/api/user", bytes.NewReader(payload)))
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusCreated, userResp.StatusCode)
+
+		payload, _ = json.Marshal(models.User{Username: "tenant-" + workspace, Password: "tenant4pass2024"})
+		loginResp, err := app.Test(httptest.NewRequest(http.MethodPost, "/api/user/login", bytes.NewReader(payload)))
+		assert.Nil(t, err)
+		var body struct {
+			Token string       `json:"token"`
+			User  user.Profile `json:"user"`
+		}
+		json.NewDecoder(loginResp.Body).Decode(&body)
+		return body.Token, body.User.WorkspaceID
+	}
+	tokenA, workspaceA := login("a-" + suffix)
+	tokenB, _ := login("b-" + suffix)
+
+	task := models.Task{Title: "Tenant A task", Status: "pending", EstimatedHours: 4}
+	database.For(database.WithWorkspace(context.Background(), workspaceA)).Create(&task)
+	payload, _ := json.Marshal(models.Task{ID: task.ID})
+
+	getReq := httptest.NewRequest(http.MethodGet, "/api/v2/task/id", bytes.NewReader(payload))
+	getReq.Header.Set("Authorization", "Bearer "+tokenA)
+	getResp, err := app.Test(getReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, getResp.StatusCode)
+
+	getReq = httptest.NewRequest(http.MethodGet, "/api/v2/task/id", bytes.NewReader(payload))
+	getReq.Header.Set("Authorization", "Bearer "+tokenB)
+	getResp, err = app.Test(getReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, getResp.StatusCode)
+}
+
+func TestAuditLogRequiresAuth(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+	auditReq := httptest.NewRequest(http.MethodGet, "/api/v2/audit?entityType=Task", nil)
+	auditResp, err := app.Test(auditReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, auditResp.StatusCode)
+	assert.NotEmpty(t, auditResp.Header.Get(fiber.HeaderXRequestID))
+}
+
+func TestAuditLogRecordsChanges(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+
+	token, workspaceID := workspaceAdmin(t, app, "audit")
+	profileReq := httptest.NewRequest(http.MethodGet, "/api/v2/user/profile", nil)
+	profileReq.Header.Set("Authorization", "Bearer "+token)
+	profileResp, err := app.Test(profileReq)
+	assert.Nil(t, err)
+	var profile user.Profile
+	json.NewDecoder(profileResp.Body).Decode(&profile)
+
+	task := models.Task{Title: "Audited task", Status: "pending", EstimatedHours: 4}
+	database.For(database.WithWorkspace(context.Background(), workspaceID)).Create(&task)
+
+	putReq := httptest.NewRequest(http.MethodPut, "/api/v2/task/id", bytes.NewReader(mustJSON(models.Task{ID: task.ID, Title: "Audited task, renamed"})))
+	putReq.Header.Set("Authorization", "Bearer "+token)
+	putResp, err := app.Test(putReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, putResp.StatusCode)
+	requestID := putResp.Header.Get(fiber.HeaderXRequestID)
+	assert.NotEmpty(t, requestID)
+
+	passwordReq := httptest.NewRequest(http.MethodPut, "/api/v2/user", bytes.NewReader(mustJSON(fiber.Map{
+		"currentPassword": "audit4pass2024",
+		"newPassword":     "audit4pass2025",
+	})))
+	passwordReq.Header.Set("Authorization", "Bearer "+token)
+	passwordResp, err := app.Test(passwordReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, passwordResp.StatusCode)
+
+	type entry struct {
+		Actor     string                 `json:"actor"`
+		Action    string                 `json:"action"`
+		Before    map[string]interface{} `json:"before"`
+		After     map[string]interface{} `json:"after"`
+		RequestID string                 `json:"requestId"`
+	}
+	auditLog := func(entityType, entityID string) []entry {
+		auditReq := httptest.NewRequest(http.MethodGet, "/api/v2/audit?entityType="+entityType+"&entityId="+url.QueryEscape(entityID), nil)
+		auditReq.Header.Set("Authorization", "Bearer "+token)
+		auditResp, err := app.Test(auditReq)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, auditResp.StatusCode)
+		var entries []entry
+		json.NewDecoder(auditResp.Body).Decode(&entries)
+		return entries
+	}
+
+	entries := auditLog("Task", strconv.Itoa(int(task.ID)))
+	if assert.NotEmpty(t, entries) {
+		update := entries[0]
+		assert.Equal(t, "update", update.Action)
+		assert.Equal(t, profile.Username, update.Actor)
+		assert.Equal(t, requestID, update.RequestID)
+		assert.Equal(t, "Audited task", update.Before["title"])
+		assert.Equal(t, "Audited task, renamed", update.After["title"])
+		assert.NotContains(t, update.After, "status")
+	}
+
+	entries = auditLog("User", profile.Username)
+	if assert.NotEmpty(t, entries) {
+		update := entries[0]
+		assert.Equal(t, "update", update.Action)
+		assert.Equal(t, "[redacted]", update.Before["password"])
+		assert.Equal(t, "[redacted]", update.After["password"])
+	}
+}
+
+func TestTrashRequiresAuth(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+	trashReq := httptest.NewRequest(http.MethodGet, "/api/v2/trash?type=task", nil)
+	trashResp, err := app.Test(trashReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, trashResp.StatusCode)
+}
+
+func TestIntegrityCheckRepairsOrphans(t *testing.T) {
+	database.ConnectDB()
+
+	// the foreign keys keep orphans out, so they are switched off for the
+	// insert as if the row predated them
+	missingParent := uint(math.MaxInt32)
+	orphan := models.Task{Title: "Orphaned subtask", Status: "pending", EstimatedHours: 1, ParentID: &missingParent}
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SET LOCAL session_replication_role = replica").Error; err != nil {
+			return err
+		}
+		return tx.Create(&orphan).Error
+	})
+	assert.Nil(t, err)
+
+	found := func(problems []routes.IntegrityProblem, repaired bool) bool {
+		for _, problem := range problems {
+			if problem.Table != "tasks" || problem.Column != "parent_id" {
+				continue
+			}
+			for _, id := range problem.IDs {
+				if id == orphan.ID {
+					return problem.Repaired == repaired
+				}
+			}
+		}
+		return false
+	}
+
+	problems, err := routes.CheckIntegrity(context.Background(), false)
+	assert.Nil(t, err)
+	assert.True(t, found(problems, false))
+
+	problems, err = routes.CheckIntegrity(context.Background(), true)
+	assert.Nil(t, err)
+	assert.True(t, found(problems, true))
+
+	var repaired models.Task
+	database.DB.First(&repaired, orphan.ID)
+	assert.Equal(t, orphan.ID, repaired.ID)
+	assert.Nil(t, repaired.ParentID)
+
+	problems, err = routes.CheckIntegrity(context.Background(), false)
+	assert.Nil(t, err)
+	assert.Empty(t, problems)
+}
+
+func TestStaleIfMatchFails(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+
+	token, workspaceID := workspaceAdmin(t, app, "etag")
+
+	task := models.Task{Title: "Versioned task", Status: "pending", EstimatedHours: 4}
+	database.For(database.WithWorkspace(context.Background(), workspaceID)).Create(&task)
+
+	payload, _ := json.Marshal(models.Task{ID: task.ID})
+	getReq := httptest.NewRequest(http.MethodGet, "/api/v2/task/id", bytes.NewReader(payload))
+	getReq.Header.Set("Authorization", "Bearer "+token)
+	getResp, err := app.Test(getReq)
+	assert.Nil(t, err)
+	etag := getResp.Header.Get(fiber.HeaderETag)
+	assert.Equal(t, `"1"`, etag)
+
+	update := func(title string) *http.Response {
+		payload, _ := json.Marshal(models.Task{ID: task.ID, Title: title})
+		putReq := httptest.NewRequest(http.MethodPut, "/api/v2/task/id", bytes.NewReader(payload))
+		putReq.Header.Set("Authorization", "Bearer "+token)
+		putReq.Header.Set(fiber.HeaderIfMatch, etag)
+		putResp, err := app.Test(putReq)
+		assert.Nil(t, err)
+		return putResp
+	}
+	putResp := update("Versioned task, first edit")
+	assert.Equal(t, http.StatusOK, putResp.StatusCode)
+	assert.Equal(t, `"2"`, putResp.Header.Get(fiber.HeaderETag))
+
+	putResp = update("Versioned task, stale edit")
+	assert.Equal(t, http.StatusPreconditionFailed, putResp.StatusCode)
+}
+
+func TestRollupInvalidatesParentETag(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+
+	token, workspaceID := workspaceAdmin(t, app, "rollup")
+	tx := database.For(database.WithWorkspace(context.Background(), workspaceID))
+	parent := models.Task{Title: "Rolled up task", Status: "pending", EstimatedHours: 2}
+	tx.Create(&parent)
+	child := models.Task{Title: "Rolled up subtask", Status: "pending", EstimatedHours: 2, ParentID: &parent.ID}
+	tx.Create(&child)
+
+	getReq := httptest.NewRequest(http.MethodGet, "/api/v2/task/id", bytes.NewReader(mustJSON(models.Task{ID: parent.ID})))
+	getReq.Header.Set("Authorization", "Bearer "+token)
+	getResp, err := app.Test(getReq)
+	assert.Nil(t, err)
+	etag := getResp.Header.Get(fiber.HeaderETag)
+
+	// changing the subtask changes the parent's hours behind the client's back
+	putReq := httptest.NewRequest(http.MethodPut, "/api/v2/task/id", bytes.NewReader(mustJSON(models.Task{ID: child.ID, EstimatedHours: 6})))
+	putReq.Header.Set("Authorization", "Bearer "+token)
+	putResp, err := app.Test(putReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, putResp.StatusCode)
+
+	putReq = httptest.NewRequest(http.MethodPut, "/api/v2/task/id", bytes.NewReader(mustJSON(models.Task{ID: parent.ID, Title: "Rolled up task, stale edit"})))
+	putReq.Header.Set("Authorization", "Bearer "+token)
+	putReq.Header.Set(fiber.HeaderIfMatch, etag)
+	putResp, err = app.Test(putReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusPreconditionFailed, putResp.StatusCode)
+
+	var rolledUp models.Task
+	tx.First(&rolledUp, parent.ID)
+	assert.Equal(t, 6, rolledUp.EstimatedHours)
+	assert.Equal(t, "Rolled up task", rolledUp.Title)
+}
+
+func TestConcurrentAssignmentsAssignOnce(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+
+	token, workspaceID := workspaceAdmin(t, app, "race")
+	task := models.Task{Title: "Contended task", Status: "pending", EstimatedHours: 8}
+	database.For(database.WithWorkspace(context.Background(), workspaceID)).Create(&task)
+
+	var admin user.Profile
+	profileReq := httptest.NewRequest(http.MethodGet, "/api/v2/user/profile", nil)
+	profileReq.Header.Set("Authorization", "Bearer "+token)
+	profileResp, err := app.Test(profileReq)
+	assert.Nil(t, err)
+	json.NewDecoder(profileResp.Body).Decode(&admin)
+
+	const attempts = 20
+	statuses := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			payload, _ := json.Marshal(models.TaskAssignment{Username: admin.Username, TaskID: task.ID, Start_Date: "2024-02-05 9:00 AM"})
+			req := httptest.NewRequest(http.MethodPost, "/api/v2/taskAssignment", bytes.NewReader(payload))
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			statuses <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	created := 0
+	for status := range statuses {
+		switch status {
+		case http.StatusOK:
+			created++
+		case http.StatusConflict:
+		default:
+			t.Errorf("unexpected status %d", status)
+		}
+	}
+	assert.Equal(t, 1, created)
+
+	var assignments int64
+	database.DB.Model(&models.TaskAssignment{}).Where("task_id = ?", task.ID).Count(&assignments)
+	assert.Equal(t, int64(1), assignments)
+}
+
+func TestManagerOnlyAssignsOwnTeam(t *testing.T) {
+	database.ConnectDB()
+	app := fiber.New()
+	routes.SetupRoutes(app)
+
+	adminToken, workspaceID := workspaceAdmin(t, app, "teamscope")
+	managerToken, manager := workspaceUser(t, app, adminToken, "teamscope-manager", models.RoleManager)
+	_, outsider := workspaceUser(t, app, adminToken, "teamscope-outsider", models.RoleMember)
+
+	tx := database.For(database.WithWorkspace(context.Background(), workspaceID))
+	task := models.Task{Title: "Team scoped task", Status: "pending", EstimatedHours: 4}
+	tx.Create(&task)
+	team := models.Team{Name: "Someone else's team"}
+	tx.Create(&team)
+	tx.Create(&models.TeamMember{TeamID: team.ID, Username: outsider})
+
+	payload, _ := json.Marshal(models.TaskAssignment{Username: outsider, TaskID: task.ID, Start_Date: "2024-01-02 9:00 AM"})
+	assignReq := httptest.NewRequest(http.MethodPost, "/api/v2/taskAssignment", bytes.NewReader(payload))
+	assignReq.Header.Set("Authorization", "Bearer "+managerToken)
+	assignResp, err := app.Test(assignReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, assignResp.StatusCode)
+
+	payload, _ = json.Marshal(models.Team{ID: team.ID})
+	teamReq := httptest.NewRequest(http.MethodGet, "/api/v2/team/id", bytes.NewReader(payload))
+	teamReq.Header.Set("Authorization", "Bearer "+managerToken)
+	teamResp, err := app.Test(teamReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, teamResp.StatusCode)
+
+	// leading the team makes both allowed
+	tx.Model(&team).Update("lead", manager)
+	assignReq = httptest.NewRequest(http.MethodPost, "/api/v2/taskAssignment", bytes.NewReader(mustJSON(models.TaskAssignment{Username: outsider, TaskID: task.ID, Start_Date: "2024-01-02 9:00 AM"})))
+	assignReq.Header.Set("Authorization", "Bearer "+managerToken)
+	assignResp, err = app.Test(assignReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, assignResp.StatusCode)
+}
+
+// workspaceUser has the admin add a user with the given role to their
+// workspace and logs the user in
+func workspaceUser(t *testing.T, app *fiber.App, adminToken, prefix, role string) (string, string) {
+	name := prefix + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	addReq := httptest.NewRequest(http.MethodPost, "/api/v2/workspace/user", bytes.NewReader(mustJSON(fiber.Map{
+		"username": name,
+		"name":     prefix,
+		"email":    name + "@example.com",
+		"password": "member4pass2024",
+	})))
+	addReq.Header.Set("Authorization", "Bearer "+adminToken)
+	addResp, err := app.Test(addReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, addResp.StatusCode)
+
+	roleReq := httptest.NewRequest(http.MethodPut, "/api/v2/user/role", bytes.NewReader(mustJSON(models.User{Username: name, Role: role})))
+	roleReq.Header.Set("Authorization", "Bearer "+adminToken)
+	roleResp, err := app.Test(roleReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, roleResp.StatusCode)
+
+	loginResp, err := app.Test(httptest.NewRequest(http.MethodPost, "/api/user/login", bytes.NewReader(mustJSON(models.User{Username: name, Password: "member4pass2024"}))))
+	assert.Nil(t, err)
+	var body struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(loginResp.Body).Decode(&body)
+	return body.Token, name
+}
+
+func mustJSON(v interface{}) []byte {
+	data, _ := json.Marshal(v)
+	return data
+}
+
+// workspaceAdmin registers the first user of a new workspace, who becomes its
+// admin, and returns their access token and the workspace
+func workspaceAdmin(t *testing.T, app *fiber.App, prefix string) (string, uint) {
+	name := prefix + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	payload, _ := json.Marshal(fiber.Map{
+		"username":  name,
+		"name":      prefix,
+		"email":     name + "@example.com",
+		"password":  prefix + "4pass2024",
+		"workspace": name,
+	})
+	userResp, err := app.Test(httptest.NewRequest(http.MethodPost, "/api/user", bytes.NewReader(payload)))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, userResp.StatusCode)
+
+	payload, _ = json.Marshal(models.User{Username: name, Password: prefix + "4pass2024"})
+	loginResp, err := app.Test(httptest.NewRequest(http.MethodPost, "/api/user/login", bytes.NewReader(payload)))
+	assert.Nil(t, err)
+	var body struct {
+		Token string       `json:"token"`
+		User  user.Profile `json:"user"`
+	}
+	json.NewDecoder(loginResp.Body).Decode(&body)
+	return body.Token, body.User.WorkspaceID
+}
+
+func TestMigrationsAreOrderedAndApplied(t *testing.T) {
+	database.ConnectDB()
+	migrations, err := database.Migrations()
+	assert.Nil(t, err)
+	for i, migration := range migrations {
+		assert.Equal(t, i+1, migration.Version)
+	}
+	assert.Nil(t, database.CheckSchema())
+}
+
+// The baseline models are those of the first release, whose AutoMigrate
+// created the schema that upgraded databases start from
+type baselineTask struct {
+	ID             uint   `gorm:"primaryKey"`
+	Title          string `gorm:"not null"`
+	Status         string `gorm:"not null"`
+	EstimatedHours int    `gorm:"not null"`
+}
+
+func (baselineTask) TableName() string { return "tasks" }
+
+type baselineTaskAssignment struct {
+	ID         uint   `gorm:"primaryKey"`
+	Username   string `gorm:"not null"`
+	TaskID     uint   `gorm:"not null"`
+	Start_Date string `gorm:"not null"`
+	End_Date   string
+}
+
+func (baselineTaskAssignment) TableName() string { return "task_assignments" }
+
+type baselineHoliday struct {
+	ID          uint   `gorm:"primaryKey"`
+	HolidayName string `gorm:"not null"`
+	HolidayDate string `gorm:"not null"`
+}
+
+func (baselineHoliday) TableName() string { return "holidays" }
+
+type baselineUser struct {
+	Username string `gorm:"primaryKey;uniqueIndex;not null"`
+	Name     string `gorm:"not null"`
+	Email    string `gorm:"not null"`
+	Password string `gorm:"not null"`
+}
+
+func (baselineUser) TableName() string { return "users" }
+
+func TestMigrateUpFromBaseline(t *testing.T) {
+	database.Connect()
+	migrated := database.DB
+	migrated.Exec("DROP SCHEMA IF EXISTS baseline_upgrade CASCADE")
+	assert.Nil(t, migrated.Exec("CREATE SCHEMA baseline_upgrade").Error)
+	defer migrated.Exec("DROP SCHEMA baseline_upgrade CASCADE")
+
+	baseline, err := database.Open(database.DSN + " search_path=baseline_upgrade")
+	assert.Nil(t, err)
+	if sqlDB, err := baseline.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+	assert.Nil(t, baseline.AutoMigrate(&baselineTask{}, &baselineUser{}, &baselineHoliday{}, &baselineTaskAssignment{}))
+	task := baselineTask{Title: "Old task", Status: "pending", EstimatedHours: 8}
+	baseline.Create(&task)
+	baseline.Create(&baselineUser{Username: "old-user", Name: "Old User", Email: "old@example.com", Password: "hash"})
+	baseline.Create(&baselineTaskAssignment{Username: "old-user", TaskID: task.ID, Start_Date: "2024-01-02", End_Date: "2024-01-03"})
+	newest := baselineTaskAssignment{Username: "old-user", TaskID: task.ID, Start_Date: "2024-01-04", End_Date: "2024-01-05"}
+	baseline.Create(&newest)
+	baseline.Create(&baselineHoliday{HolidayName: "New Year", HolidayDate: "2024-01-01"})
+
+	database.DB = baseline
+	_, err = database.MigrateUp()
+	schemaErr := database.CheckSchema()
+	database.DB = migrated
+	assert.Nil(t, err)
+	assert.Nil(t, schemaErr)
+
+	var upgradedTask models.Task
+	baseline.First(&upgradedTask, task.ID)
+	assert.Equal(t, uint(1), upgradedTask.Version)
+	assert.Equal(t, uint(models.DefaultWorkspaceID), upgradedTask.WorkspaceID)
+	assert.False(t, upgradedTask.DeletedAt.Valid)
+
+	var upgradedUser models.User
+	baseline.First(&upgradedUser, "username = ?", "old-user")
+	assert.Equal(t, models.RoleMember, upgradedUser.Role)
+	assert.True(t, upgradedUser.Active)
+
+	var live []models.TaskAssignment
+	baseline.Where("task_id = ?", task.ID).Find(&live)
+	if assert.Len(t, live, 1) {
+		assert.Equal(t, newest.ID, live[0].ID)
+	}
+	var trashed int64
+	baseline.Unscoped().Model(&models.TaskAssignment{}).Where("task_id = ? AND deleted_at IS NOT NULL", task.ID).Count(&trashed)
+	assert.Equal(t, int64(1), trashed)
+}
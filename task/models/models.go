@@ -1,29 +1,340 @@
 package models
 
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
 type Task struct {
-	ID             uint   `gorm:"primaryKey" json:"id"`
-	Title          string `gorm:"not null" json:"title"`
-	Status         string `gorm:"not null" json:"status"`
-	EstimatedHours int    `gorm:"not null" json:"estimatedHours"`
+	ID             uint          `gorm:"primaryKey" json:"id"`
+	Title          string        `gorm:"not null" json:"title"`
+	Status         string        `gorm:"not null" json:"status"`
+	EstimatedHours int           `gorm:"not null" json:"estimatedHours"`
+	ParentID       *uint         `gorm:"index" json:"parentId,omitempty"`
+	Children       []Task        `gorm:"foreignKey:ParentID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL" json:"children,omitempty"`
+	TemplateID     *uint         `gorm:"index;uniqueIndex:idx_tasks_template_due_date,where:template_id IS NOT NULL" json:"templateId,omitempty"`
+	Template       *TaskTemplate `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL" json:"-"`
+	DueDate        string        `gorm:"uniqueIndex:idx_tasks_template_due_date,where:template_id IS NOT NULL" json:"dueDate,omitempty"`
+
+	// Version goes up by one with every change to the row and is served as
+	// its ETag
+	Version     uint           `gorm:"not null;default:1" json:"version"`
+	DeletedAt   gorm.DeletedAt `gorm:"index" json:"deletedAt,omitempty"`
+	WorkspaceID uint           `gorm:"not null;default:1;index" json:"-"`
 }
 
+// TaskTemplate describes a chore that recurs. Frequency is daily, weekly or
+// monthly and repeats every Interval periods from StartDate. Weekly rules run
+// on ByDay ("MO,WE"); monthly rules run on the ByWeekNo-th ByDay of the month
+// (-1 is the last one) or, without ByDay, on StartDate's day of the month.
+type TaskTemplate struct {
+	ID               uint   `gorm:"primaryKey" json:"id"`
+	Title            string `gorm:"not null" json:"title"`
+	EstimatedHours   int    `gorm:"not null" json:"estimatedHours"`
+	Frequency        string `gorm:"not null" json:"frequency"`
+	Interval         int    `gorm:"not null;default:1" json:"interval"`
+	ByDay            string `json:"byDay"`
+	ByWeekNo         int    `json:"byWeekNo"`
+	StartDate        string `gorm:"not null" json:"startDate"`
+	Until            string `json:"until"`
+	Assignees        string `json:"assignees"`
+	NextAssignee     int    `json:"nextAssignee"`
+	GeneratedThrough string `json:"generatedThrough"`
+	WorkspaceID      uint   `gorm:"not null;default:1;index" json:"-"`
+}
+
+// TaskAssignment gives a task to a user. A task has at most one live
+// assignment. It goes away with its task, while a user with assignments
+// can't be deleted, only deactivated.
 type TaskAssignment struct {
 	ID         uint   `gorm:"primaryKey" json:"id"`
-	Username   string `gorm:"not null" json:"username"`
-	TaskID     uint   `gorm:"not null" json:"taskid"`
+	Username   string `gorm:"not null;index" json:"username"`
+	TaskID     uint   `gorm:"not null;index;uniqueIndex:idx_task_assignments_live_task,where:deleted_at IS NULL" json:"taskid"`
+	Task       *Task  `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"-"`
 	Start_Date string `gorm:"not null" json:"startDate"`
 	End_Date   string `json:"endDate"`
+
+	// NeedsReassignment is set when the assignee's account was deactivated
+	// while the task was still open
+	NeedsReassignment bool           `gorm:"not null;default:false" json:"needsReassignment"`
+	Version           uint           `gorm:"not null;default:1" json:"version"`
+	DeletedAt         gorm.DeletedAt `gorm:"index" json:"deletedAt,omitempty"`
+	WorkspaceID       uint           `gorm:"not null;default:1;index" json:"-"`
 }
 
 type Holiday struct {
-	ID          uint   `gorm:"primaryKey" json:"id"`
-	HolidayName string `gorm:"not null" json:"holidayName"`
-	HolidayDate string `gorm:"not null" json:"holidayDate"`
+	ID          uint           `gorm:"primaryKey" json:"id"`
+	HolidayName string         `gorm:"not null" json:"holidayName"`
+	HolidayDate string         `gorm:"not null" json:"holidayDate"`
+	Version     uint           `gorm:"not null;default:1" json:"version"`
+	DeletedAt   gorm.DeletedAt `gorm:"index" json:"deletedAt,omitempty"`
+	WorkspaceID uint           `gorm:"not null;default:1;index" json:"-"`
 }
 
+// DefaultWorkspaceID is the workspace that existing data and users who
+// register without naming a workspace belong to
+const DefaultWorkspaceID = 1
+
+// Workspace separates the data of one business unit from the others. Every
+// model with a WorkspaceID belongs to exactly one.
+type Workspace struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Name      string    `gorm:"not null;uniqueIndex" json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Roles a user can hold, from most to least privileged
+const (
+	RoleAdmin   = "admin"
+	RoleManager = "manager"
+	RoleMember  = "member"
+	RoleViewer  = "viewer"
+)
+
 type User struct {
 	Username string `gorm:"primaryKey;uniqueIndex;not null" json:"username"`
 	Name     string `gorm:"not null" json:"name"`
-	Email    string `gorm:"not null" json:"email"`
+	Email    string `gorm:"not null;uniqueIndex:idx_users_email,expression:LOWER(email),where:email <> ''" json:"email"`
 	Password string `gorm:"not null" json:"password"`
+	Role     string `gorm:"not null;default:member" json:"role"`
+
+	// EmailVerified is set once the user opens the link mailed to Email, or
+	// when an admin vouches for the address
+	EmailVerified bool `gorm:"not null;default:false" json:"emailVerified"`
+
+	// Active is cleared when an admin deactivates the account, which blocks
+	// every way of logging in until it is reactivated
+	Active        bool       `gorm:"not null;default:true" json:"active"`
+	DeactivatedAt *time.Time `json:"deactivatedAt,omitempty"`
+
+	// MFASecret is set when TOTP enrollment starts and only takes effect
+	// once MFAEnabled is set by a verified code
+	MFASecret   string `json:"-"`
+	MFAEnabled  bool   `gorm:"not null;default:false" json:"mfaEnabled"`
+	MFALastStep int64  `json:"-"`
+
+	// OIDCIssuer and OIDCSubject link the account to an identity at the
+	// single sign-on provider
+	OIDCIssuer  string `gorm:"index:idx_users_oidc" json:"-"`
+	OIDCSubject string `gorm:"index:idx_users_oidc" json:"-"`
+	WorkspaceID uint   `gorm:"not null;default:1;index" json:"-"`
+
+	// Assignments only declares the foreign key from task assignments
+	Assignments []TaskAssignment `gorm:"foreignKey:Username;references:Username;constraint:OnUpdate:CASCADE,OnDelete:RESTRICT" json:"-"`
+}
+
+// Team groups users under a lead. Teams nest through ParentID, so a
+// department is a team whose children are its teams.
+type Team struct {
+	ID          uint         `gorm:"primaryKey" json:"id"`
+	Name        string       `gorm:"not null" json:"name"`
+	ParentID    *uint        `gorm:"index" json:"parentId,omitempty"`
+	Lead        string       `json:"lead"`
+	Members     []TeamMember `gorm:"foreignKey:TeamID" json:"members,omitempty"`
+	Children    []Team       `gorm:"foreignKey:ParentID" json:"children,omitempty"`
+	WorkspaceID uint         `gorm:"not null;default:1;index" json:"-"`
+}
+
+type TeamMember struct {
+	ID          uint   `gorm:"primaryKey" json:"id"`
+	TeamID      uint   `gorm:"not null;uniqueIndex:idx_team_members_team_user" json:"teamId"`
+	Username    string `gorm:"not null;uniqueIndex:idx_team_members_team_user;index" json:"username"`
+	WorkspaceID uint   `gorm:"not null;default:1;index" json:"-"`
+}
+
+type Comment struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	TaskID      uint      `gorm:"not null;index" json:"taskid"`
+	Task        *Task     `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"-"`
+	Author      string    `gorm:"not null" json:"author"`
+	Body        string    `gorm:"not null" json:"body"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+	WorkspaceID uint      `gorm:"not null;default:1;index" json:"-"`
+}
+
+// TaskActivity records a status or assignment change on a task
+type TaskActivity struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	TaskID      uint      `gorm:"not null;index" json:"taskid"`
+	Task        *Task     `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"-"`
+	Actor       string    `json:"actor"`
+	Kind        string    `gorm:"not null" json:"kind"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	CreatedAt   time.Time `json:"createdAt"`
+	WorkspaceID uint      `gorm:"not null;default:1;index" json:"-"`
+}
+
+// Attachment is a file uploaded to a task. Deleting the task is refused
+// while attachments remain, since their files have to be removed as well.
+type Attachment struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	TaskID      uint      `gorm:"not null;index" json:"taskid"`
+	Task        *Task     `gorm:"constraint:OnUpdate:CASCADE,OnDelete:RESTRICT" json:"-"`
+	Filename    string    `gorm:"not null" json:"filename"`
+	ContentType string    `gorm:"not null" json:"contentType"`
+	Size        int64     `gorm:"not null" json:"size"`
+	Checksum    string    `gorm:"not null" json:"checksum"`
+	StorageKey  string    `gorm:"not null;uniqueIndex" json:"-"`
+	UploadedBy  string    `json:"uploadedBy"`
+	CreatedAt   time.Time `json:"createdAt"`
+	WorkspaceID uint      `gorm:"not null;default:1;index" json:"-"`
+}
+
+// TimeEntry is effort logged by a user against a task assignment. A running
+// timer is an entry with StartedAt set and EndedAt still nil.
+type TimeEntry struct {
+	ID               uint            `gorm:"primaryKey" json:"id"`
+	TaskAssignmentID uint            `gorm:"not null;index" json:"taskAssignmentId"`
+	TaskAssignment   *TaskAssignment `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE" json:"-"`
+	Username         string          `gorm:"not null;index" json:"username"`
+	Date             string          `gorm:"not null" json:"date"`
+	Hours            float64         `gorm:"not null" json:"hours"`
+	Note             string          `json:"note"`
+	StartedAt        *time.Time      `json:"startedAt,omitempty"`
+	EndedAt          *time.Time      `json:"endedAt,omitempty"`
+	CreatedAt        time.Time       `json:"createdAt"`
+	WorkspaceID      uint            `gorm:"not null;default:1;index" json:"-"`
+}
+
+// RefreshToken is one link in a login session's chain of refresh tokens.
+// Every refresh rotates the token; all links share the session's FamilyID.
+type RefreshToken struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	Username   string     `gorm:"not null;index" json:"username"`
+	FamilyID   string     `gorm:"not null;index" json:"familyId"`
+	TokenHash  string     `gorm:"not null;uniqueIndex" json:"-"`
+	ExpiresAt  time.Time  `gorm:"not null" json:"expiresAt"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+	ReplacedBy uint       `json:"replacedBy,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+
+	// MFAVerified is set when the session was opened with a second factor,
+	// and carries over to every token the session rotates to
+	MFAVerified bool `gorm:"not null;default:false" json:"mfaVerified"`
+}
+
+// PasswordReset is a single-use token mailed to a user who forgot their
+// password. Only its hash is stored.
+type PasswordReset struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	Username  string     `gorm:"not null;index" json:"username"`
+	TokenHash string     `gorm:"not null;uniqueIndex" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// EmailVerification is a single-use token mailed to confirm that Email
+// belongs to the user. It stops working once the user changes the address.
+type EmailVerification struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	Username  string     `gorm:"not null;index" json:"username"`
+	Email     string     `gorm:"not null" json:"email"`
+	TokenHash string     `gorm:"not null;uniqueIndex" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// LoginThrottle counts recent failed logins for one username ("user:...") or
+// one client address ("ip:...")
+type LoginThrottle struct {
+	Key           string     `gorm:"primaryKey" json:"key"`
+	Failures      int        `gorm:"not null" json:"failures"`
+	LastFailureAt time.Time  `json:"lastFailureAt"`
+	NextAttemptAt time.Time  `json:"nextAttemptAt"`
+	LockedUntil   *time.Time `json:"lockedUntil,omitempty"`
+}
+
+// RecoveryCode is a one-time code that stands in for a TOTP code when the
+// authenticator is lost
+type RecoveryCode struct {
+	ID       uint       `gorm:"primaryKey" json:"id"`
+	Username string     `gorm:"not null;index" json:"username"`
+	CodeHash string     `gorm:"not null" json:"-"`
+	UsedAt   *time.Time `json:"usedAt,omitempty"`
+}
+
+// APIKey is a long-lived credential for scripts. Scope is the most
+// privileged role the key may act as; it never exceeds the owner's role.
+type APIKey struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	Username   string     `gorm:"not null;index" json:"username"`
+	Name       string     `gorm:"not null" json:"name"`
+	Prefix     string     `gorm:"not null" json:"prefix"`
+	KeyHash    string     `gorm:"not null;uniqueIndex" json:"-"`
+	Scope      string     `gorm:"not null" json:"scope"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+// OIDCLoginState remembers an authorization request between redirecting the
+// browser to the identity provider and the provider redirecting it back
+type OIDCLoginState struct {
+	State     string    `gorm:"primaryKey"`
+	Nonce     string    `gorm:"not null"`
+	Verifier  string    `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+}
+
+// AuditLog records one change to an audited model. Before and After only
+// hold the fields that changed; creates have no Before and deletes no After.
+// Rows are never updated or deleted.
+type AuditLog struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	WorkspaceID uint      `gorm:"not null;default:1;index" json:"-"`
+	Actor       string    `gorm:"index" json:"actor"`
+	Action      string    `gorm:"not null" json:"action"`
+	EntityType  string    `gorm:"not null;index:idx_audit_logs_entity" json:"entityType"`
+	EntityID    string    `gorm:"not null;index:idx_audit_logs_entity" json:"entityId"`
+	Before      RawJSON   `gorm:"type:jsonb" json:"before"`
+	After       RawJSON   `gorm:"type:jsonb" json:"after"`
+	RequestID   string    `json:"requestId"`
+	CreatedAt   time.Time `gorm:"index" json:"createdAt"`
+}
+
+// SchemaMigration records a migration applied to the database
+type SchemaMigration struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false" json:"version"`
+	Name      string    `gorm:"not null" json:"name"`
+	AppliedAt time.Time `gorm:"not null" json:"appliedAt"`
+}
+
+// RawJSON is a JSON document kept in a jsonb column
+type RawJSON json.RawMessage
+
+func (j RawJSON) Value() (driver.Value, error) {
+	if len(j) == 0 {
+		return nil, nil
+	}
+	return string(j), nil
+}
+
+func (j *RawJSON) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*j = nil
+	case []byte:
+		*j = append((*j)[:0], v...)
+	case string:
+		*j = RawJSON(v)
+	default:
+		return fmt.Errorf("cannot scan %T into RawJSON", src)
+	}
+	return nil
+}
+
+func (j RawJSON) MarshalJSON() ([]byte, error) {
+	if len(j) == 0 {
+		return []byte("null"), nil
+	}
+	return j, nil
 }
@@ -0,0 +1,149 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/saran-crayonte/task/models"
+	"github.com/saran-crayonte/task/user"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DeactivateUser blocks an account from logging in and ends its sessions.
+// The user's assignments on open tasks move to reassignTo when it is given;
+// otherwise they are flagged so a manager can hand them out.
+func DeactivateUser(c fiber.Ctx) error {
+	var formData struct {
+		Username   string `json:"username"`
+		ReassignTo string `json:"reassignTo"`
+	}
+	if err := json.Unmarshal(c.Body(), &formData); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	if formData.Username == c.Locals("username") {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "You can't deactivate your own account"})
+	}
+
+	// everything happens in one transaction, so a user is never left
+	// deactivated with only part of their work moved. The user stays locked
+	// until then, which keeps new assignments from slipping in.
+	var openAssignments []models.TaskAssignment
+	err := db(c).Transaction(func(tx *gorm.DB) error {
+		var existingUser models.User
+		tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&existingUser, "username = ?", formData.Username)
+		if len(existingUser.Username) == 0 {
+			return fiber.NewError(fiber.StatusNotFound, "Username doesn't exists")
+		}
+		if !existingUser.Active {
+			return fiber.NewError(fiber.StatusConflict, "User is already deactivated")
+		}
+
+		if formData.ReassignTo != "" {
+			var newAssignee models.User
+			tx.Clauses(clause.Locking{Strength: "SHARE"}).First(&newAssignee, "username = ?", formData.ReassignTo)
+			if len(newAssignee.Username) == 0 || newAssignee.Username == existingUser.Username {
+				return fiber.NewError(fiber.StatusBadRequest, "reassignTo must be another existing user")
+			}
+			if !newAssignee.Active {
+				return fiber.NewError(fiber.StatusBadRequest, "reassignTo is deactivated")
+			}
+		}
+
+		err := tx.Model(&existingUser).Updates(map[string]interface{}{
+			"active":         false,
+			"deactivated_at": time.Now(),
+		}).Error
+		if err != nil {
+			return err
+		}
+		if err := user.RevokeSessions(tx, existingUser.Username); err != nil {
+			return err
+		}
+
+		err = tx.Joins("JOIN tasks ON tasks.id = task_assignments.task_id").
+			Where("task_assignments.username = ? AND tasks.status <> ?", existingUser.Username, TaskStatusCompleted).
+			Find(&openAssignments).Error
+		if err != nil {
+			return err
+		}
+		for _, assignment := range openAssignments {
+			if formData.ReassignTo == "" {
+				if err := tx.Model(&assignment).Updates(bumped(map[string]interface{}{"needs_reassignment": true})).Error; err != nil {
+					return err
+				}
+				continue
+			}
+			// the task keeps a single assignee, only who it is changes
+			if _, err := lockUnassignedTask(tx, assignment.TaskID, assignment.ID); err != nil {
+				return err
+			}
+			err := tx.Model(&assignment).Updates(bumped(map[string]interface{}{
+				"username":           formData.ReassignTo,
+				"needs_reassignment": false,
+			})).Error
+			if err != nil {
+				return assignmentError(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return transactionError(c, err, "user could not be deactivated")
+	}
+	if formData.ReassignTo != "" {
+		for _, assignment := range openAssignments {
+			recordActivity(c, assignment.TaskID, ActivityAssignment, formData.Username, formData.ReassignTo)
+		}
+	}
+
+	message := fmt.Sprintf("User deactivated, %d open assignments flagged", len(openAssignments))
+	if formData.ReassignTo != "" {
+		message = fmt.Sprintf("User deactivated, %d open assignments moved to %s", len(openAssignments), formData.ReassignTo)
+	}
+	return c.JSON(fiber.Map{
+		"message": message,
+	})
+}
+
+// ReactivateUser lets a deactivated account log in again. Assignments that
+// are still flagged and still belong to the user are unflagged.
+func ReactivateUser(c fiber.Ctx) error {
+	var formData struct {
+		Username string `json:"username"`
+	}
+	if err := json.Unmarshal(c.Body(), &formData); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+
+	var existingUser models.User
+	db(c).First(&existingUser, "username = ?", formData.Username)
+	if len(existingUser.Username) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Username doesn't exists"})
+	}
+	if existingUser.Active {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "User is already active"})
+	}
+
+	db(c).Model(&existingUser).Updates(map[string]interface{}{
+		"active":         true,
+		"deactivated_at": nil,
+	})
+	db(c).Model(&models.TaskAssignment{}).
+		Where("username = ? AND needs_reassignment = ?", existingUser.Username, true).
+		Updates(bumped(map[string]interface{}{"needs_reassignment": false}))
+
+	return c.JSON(fiber.Map{
+		"message": "User reactivated successfully",
+	})
+}
+
+// GetFlaggedTaskAssignments lists assignments left behind by deactivated
+// users
+func GetFlaggedTaskAssignments(c fiber.Ctx) error {
+	var assignments []models.TaskAssignment
+	db(c).Where("needs_reassignment = ?", true).Order("id").Find(&assignments)
+	return c.JSON(assignments)
+}
@@ -0,0 +1,202 @@
+package routes
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/saran-crayonte/task/models"
+	"github.com/saran-crayonte/task/storage"
+	"github.com/saran-crayonte/task/user"
+	"gorm.io/gorm"
+)
+
+// MaxAttachmentSize is the largest file accepted by UploadAttachment, in bytes
+var MaxAttachmentSize int64 = 10 << 20
+
+// AttachmentStore is where attachment contents are kept; the database only
+// holds their metadata
+var AttachmentStore storage.Storage = storage.NewFileSystem("attachments")
+
+func UploadAttachment(c fiber.Ctx) error {
+	username, ok := c.Locals("username").(string)
+	if !ok {
+		return fiber.ErrUnauthorized
+	}
+
+	taskID, err := strconv.ParseUint(c.FormValue("taskid"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid task id"})
+	}
+	var existingTask models.Task
+	db(c).First(&existingTask, taskID)
+	if existingTask.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task not found"})
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "file is required"})
+	}
+	if fileHeader.Size > MaxAttachmentSize {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": "file is too large"})
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "file could not be read"})
+	}
+	defer file.Close()
+
+	// the client supplied content type is not trusted, sniff it from the data
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "file could not be read"})
+	}
+	head = head[:n]
+	contentType := http.DetectContentType(head)
+
+	key, err := newStorageKey(existingTask.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "file could not be stored"})
+	}
+	hash := sha256.New()
+	reader := io.TeeReader(io.MultiReader(bytes.NewReader(head), file), hash)
+	size, err := AttachmentStore.Save(key, io.LimitReader(reader, MaxAttachmentSize+1))
+	if err != nil {
+		log.Println("Error storing attachment.", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "file could not be stored"})
+	}
+	if size > MaxAttachmentSize {
+		AttachmentStore.Delete(key)
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": "file is too large"})
+	}
+
+	attachment := models.Attachment{
+		TaskID:      existingTask.ID,
+		Filename:    fileHeader.Filename,
+		ContentType: contentType,
+		Size:        size,
+		Checksum:    hex.EncodeToString(hash.Sum(nil)),
+		StorageKey:  key,
+		UploadedBy:  username,
+	}
+	if err := db(c).Create(&attachment).Error; err != nil {
+		log.Println("Error saving attachment.", err)
+		removeAttachmentFile(attachment)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "file could not be stored"})
+	}
+	return c.Status(fiber.StatusCreated).JSON(attachment)
+}
+
+func GetAttachments(c fiber.Ctx) error {
+	attachment := new(models.Attachment)
+	if err := json.Unmarshal(c.Body(), &attachment); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var existingTask models.Task
+	db(c).First(&existingTask, attachment.TaskID)
+	if existingTask.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task not found"})
+	}
+
+	var attachments []models.Attachment
+	db(c).Where("task_id = ?", existingTask.ID).Order("id").Find(&attachments)
+	return c.JSON(attachments)
+}
+
+func DownloadAttachment(c fiber.Ctx) error {
+	attachment := new(models.Attachment)
+	if err := json.Unmarshal(c.Body(), &attachment); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var existingAttachment models.Attachment
+	db(c).First(&existingAttachment, attachment.ID)
+	if existingAttachment.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Attachment not found"})
+	}
+
+	file, err := AttachmentStore.Open(existingAttachment.StorageKey)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Attachment file is missing"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "file could not be read"})
+	}
+
+	c.Attachment(existingAttachment.Filename)
+	c.Set(fiber.HeaderContentType, existingAttachment.ContentType)
+	c.Set("X-Checksum-Sha256", existingAttachment.Checksum)
+	return c.SendStream(file, int(existingAttachment.Size))
+}
+
+func DeleteAttachment(c fiber.Ctx) error {
+	attachment := new(models.Attachment)
+	if err := json.Unmarshal(c.Body(), &attachment); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var existingAttachment models.Attachment
+	db(c).First(&existingAttachment, attachment.ID)
+	if existingAttachment.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Attachment not found"})
+	}
+	if !canDeleteAttachment(c, existingAttachment) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only the uploader, an admin or the task's manager can delete this attachment"})
+	}
+
+	if err := deleteAttachment(db(c), existingAttachment); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "attachment could not be deleted"})
+	}
+	return c.JSON(fiber.Map{
+		"message": "Attachment deleted successfully",
+	})
+}
+
+// canDeleteAttachment lets the uploader and admins delete an attachment, as
+// well as the managers in charge of its task: those leading a team of the
+// task's assignee
+func canDeleteAttachment(c fiber.Ctx, attachment models.Attachment) bool {
+	caller, _ := c.Locals("username").(string)
+	if caller == attachment.UploadedBy || user.HasRole(c, models.RoleAdmin) {
+		return true
+	}
+	if !user.HasRole(c, models.RoleManager) {
+		return false
+	}
+	var assignment models.TaskAssignment
+	db(c).Where("task_id = ?", attachment.TaskID).First(&assignment)
+	return assignment.ID != 0 && leadsTeamOf(db(c), caller, assignment.Username)
+}
+
+// deleteAttachment removes the row and then the file, so a failed delete
+// never leaves a row pointing at a missing file
+func deleteAttachment(tx *gorm.DB, attachment models.Attachment) error {
+	if err := tx.Delete(&attachment).Error; err != nil {
+		return err
+	}
+	removeAttachmentFile(attachment)
+	return nil
+}
+
+func removeAttachmentFile(attachment models.Attachment) {
+	if err := AttachmentStore.Delete(attachment.StorageKey); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Println("Error deleting attachment file.", err)
+	}
+}
+
+func newStorageKey(taskID uint) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("tasks/%d/%s", taskID, hex.EncodeToString(b)), nil
+}
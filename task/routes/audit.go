@@ -0,0 +1,69 @@
+package routes
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/requestid"
+	"github.com/saran-crayonte/task/database"
+	"github.com/saran-crayonte/task/models"
+)
+
+// MaxAuditEntries caps how many entries one audit query returns
+const MaxAuditEntries = 1000
+
+// withRequestID tags the database changes of a request with its request ID
+// so audit entries can be traced back to it. It runs after requestid.New.
+func withRequestID(c fiber.Ctx) error {
+	c.SetUserContext(database.WithRequestID(c.UserContext(), requestid.FromContext(c)))
+	return c.Next()
+}
+
+// GetAuditLog lists audit entries of the caller's workspace, newest first.
+// It filters on the entityType, entityId, actor, action and requestId query
+// parameters, on since and until (RFC 3339), and returns at most limit
+// entries.
+func GetAuditLog(c fiber.Ctx) error {
+	query := db(c).Model(&models.AuditLog{})
+	for param, column := range map[string]string{
+		"entityType": "entity_type",
+		"entityId":   "entity_id",
+		"actor":      "actor",
+		"action":     "action",
+		"requestId":  "request_id",
+	} {
+		if value := c.Query(param); value != "" {
+			query = query.Where(column+" = ?", value)
+		}
+	}
+	if since := c.Query("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid since, use RFC 3339"})
+		}
+		query = query.Where("created_at >= ?", t)
+	}
+	if until := c.Query("until"); until != "" {
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid until, use RFC 3339"})
+		}
+		query = query.Where("created_at < ?", t)
+	}
+	limit := 100
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "limit must be a positive number"})
+		}
+		limit = n
+	}
+	if limit > MaxAuditEntries {
+		limit = MaxAuditEntries
+	}
+
+	var entries []models.AuditLog
+	query.Order("id DESC").Limit(limit).Find(&entries)
+	return c.JSON(entries)
+}
@@ -0,0 +1,179 @@
+package routes
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/saran-crayonte/task/models"
+)
+
+// Kinds of entries in a task's activity feed
+const (
+	ActivityComment    = "comment"
+	ActivityStatus     = "status"
+	ActivityAssignment = "assignment"
+)
+
+type ActivityEntry struct {
+	Kind      string    `json:"kind"`
+	Actor     string    `json:"actor"`
+	Body      string    `json:"body,omitempty"`
+	From      string    `json:"from,omitempty"`
+	To        string    `json:"to,omitempty"`
+	CommentID uint      `json:"commentId,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func CreateComment(c fiber.Ctx) error {
+	username, ok := c.Locals("username").(string)
+	if !ok {
+		return fiber.ErrUnauthorized
+	}
+	comment := new(models.Comment)
+	if err := json.Unmarshal(c.Body(), &comment); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	if comment.Body == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Comment body is required"})
+	}
+
+	var existingTask models.Task
+	db(c).First(&existingTask, comment.TaskID)
+	if existingTask.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task not found"})
+	}
+
+	newComment := models.Comment{
+		TaskID: existingTask.ID,
+		Author: username,
+		Body:   comment.Body,
+	}
+	db(c).Create(&newComment)
+	return c.Status(fiber.StatusCreated).JSON(newComment)
+}
+
+func GetComments(c fiber.Ctx) error {
+	comment := new(models.Comment)
+	if err := json.Unmarshal(c.Body(), &comment); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var existingTask models.Task
+	db(c).First(&existingTask, comment.TaskID)
+	if existingTask.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task not found"})
+	}
+
+	var comments []models.Comment
+	db(c).Where("task_id = ?", existingTask.ID).Order("created_at").Find(&comments)
+	return c.JSON(comments)
+}
+
+func UpdateComment(c fiber.Ctx) error {
+	username, ok := c.Locals("username").(string)
+	if !ok {
+		return fiber.ErrUnauthorized
+	}
+	comment := new(models.Comment)
+	if err := json.Unmarshal(c.Body(), &comment); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	if comment.Body == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Comment body is required"})
+	}
+
+	var existingComment models.Comment
+	db(c).First(&existingComment, comment.ID)
+	if existingComment.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Comment not found"})
+	}
+	if existingComment.Author != username {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only the author can edit this comment"})
+	}
+
+	db(c).Model(&existingComment).Update("body", comment.Body)
+	return c.JSON(existingComment)
+}
+
+func DeleteComment(c fiber.Ctx) error {
+	username, ok := c.Locals("username").(string)
+	if !ok {
+		return fiber.ErrUnauthorized
+	}
+	comment := new(models.Comment)
+	if err := json.Unmarshal(c.Body(), &comment); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+
+	var existingComment models.Comment
+	db(c).First(&existingComment, comment.ID)
+	if existingComment.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Comment not found"})
+	}
+	if existingComment.Author != username {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only the author can delete this comment"})
+	}
+
+	db(c).Delete(&existingComment)
+	return c.JSON(fiber.Map{
+		"message": "Comment deleted successfully",
+	})
+}
+
+// GetTaskActivity returns comments, status changes and assignment changes
+// of a task interleaved oldest first
+func GetTaskActivity(c fiber.Ctx) error {
+	task := new(models.Task)
+	if err := json.Unmarshal(c.Body(), &task); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var existingTask models.Task
+	db(c).First(&existingTask, task.ID)
+	if existingTask.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task not found"})
+	}
+
+	var comments []models.Comment
+	db(c).Where("task_id = ?", existingTask.ID).Find(&comments)
+	var activities []models.TaskActivity
+	db(c).Where("task_id = ?", existingTask.ID).Find(&activities)
+
+	feed := make([]ActivityEntry, 0, len(comments)+len(activities))
+	for _, comment := range comments {
+		feed = append(feed, ActivityEntry{
+			Kind:      ActivityComment,
+			Actor:     comment.Author,
+			Body:      comment.Body,
+			CommentID: comment.ID,
+			CreatedAt: comment.CreatedAt,
+		})
+	}
+	for _, activity := range activities {
+		feed = append(feed, ActivityEntry{
+			Kind:      activity.Kind,
+			Actor:     activity.Actor,
+			From:      activity.From,
+			To:        activity.To,
+			CreatedAt: activity.CreatedAt,
+		})
+	}
+	sort.SliceStable(feed, func(i, j int) bool {
+		return feed[i].CreatedAt.Before(feed[j].CreatedAt)
+	})
+	return c.JSON(feed)
+}
+
+func recordActivity(c fiber.Ctx, taskID uint, kind, from, to string) {
+	if from == to {
+		return
+	}
+	actor, _ := c.Locals("username").(string)
+	db(c).Create(&models.TaskActivity{
+		TaskID: taskID,
+		Actor:  actor,
+		Kind:   kind,
+		From:   from,
+		To:     to,
+	})
+}
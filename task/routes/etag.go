@@ -0,0 +1,53 @@
+package routes
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+	"gorm.io/gorm"
+)
+
+// etag is the entity tag of a row at the given version
+func etag(version uint) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+func setETag(c fiber.Ctx, version uint) {
+	c.Set(fiber.HeaderETag, etag(version))
+}
+
+// bumped adds the version bump to the columns written to a task, assignment
+// or holiday, so a client still holding the row's old ETag can't write over
+// the change
+func bumped(columns map[string]interface{}) map[string]interface{} {
+	columns["version"] = gorm.Expr("version + 1")
+	return columns
+}
+
+// ifMatch reports whether the request's If-Match header allows a write to a
+// row at version. Without the header every write is allowed.
+func ifMatch(c fiber.Ctx, version uint) bool {
+	header := c.Get(fiber.HeaderIfMatch)
+	if header == "" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// staleError is the error for a write based on an outdated version of what
+func staleError(what string) *fiber.Error {
+	return fiber.NewError(fiber.StatusPreconditionFailed, what+" was changed by someone else, reload it and try again")
+}
+
+// preconditionFailed answers a write based on an outdated version of what
+func preconditionFailed(c fiber.Ctx, what string) error {
+	err := staleError(what)
+	return c.Status(err.Code).JSON(fiber.Map{"error": err.Message})
+}
@@ -0,0 +1,153 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/saran-crayonte/task/database"
+	"github.com/saran-crayonte/task/models"
+	"gorm.io/gorm"
+)
+
+// IntegrityProblem lists the rows of Table whose Column points at a row of
+// References that doesn't exist
+type IntegrityProblem struct {
+	Table      string `json:"table"`
+	Column     string `json:"column"`
+	References string `json:"references"`
+	IDs        []uint `json:"ids"`
+	Repair     string `json:"repair"`
+	Repaired   bool   `json:"repaired"`
+}
+
+type reference struct {
+	table, column       string
+	refTable, refColumn string
+	repair              string
+	// fix repairs the rows in tx. What can't be rolled back, like removing
+	// files, it hands back as afterCommit to run once every repair went
+	// through.
+	fix func(tx *gorm.DB, ids []uint) (afterCommit func(), err error)
+}
+
+// references are checked in order, so rows that hang off an orphan deleted
+// by an earlier check are gone before their own check runs
+var references = []reference{
+	{"tasks", "parent_id", "tasks", "id", "parent cleared", rollbackOnly(func(tx *gorm.DB, ids []uint) error {
+		return tx.Unscoped().Model(&models.Task{}).Where("id IN ?", ids).Updates(bumped(map[string]interface{}{"parent_id": nil})).Error
+	})},
+	{"tasks", "template_id", "task_templates", "id", "template cleared", rollbackOnly(func(tx *gorm.DB, ids []uint) error {
+		return tx.Unscoped().Model(&models.Task{}).Where("id IN ?", ids).Updates(bumped(map[string]interface{}{"template_id": nil})).Error
+	})},
+	{"task_assignments", "task_id", "tasks", "id", "deleted with their time entries", rollbackOnly(purgeTaskAssignments)},
+	{"task_assignments", "username", "users", "username", "deleted with their time entries", rollbackOnly(purgeTaskAssignments)},
+	{"time_entries", "task_assignment_id", "task_assignments", "id", "deleted", rollbackOnly(func(tx *gorm.DB, ids []uint) error {
+		return tx.Where("id IN ?", ids).Delete(&models.TimeEntry{}).Error
+	})},
+	{"comments", "task_id", "tasks", "id", "deleted", rollbackOnly(func(tx *gorm.DB, ids []uint) error {
+		return tx.Where("id IN ?", ids).Delete(&models.Comment{}).Error
+	})},
+	{"task_activities", "task_id", "tasks", "id", "deleted", rollbackOnly(func(tx *gorm.DB, ids []uint) error {
+		return tx.Where("id IN ?", ids).Delete(&models.TaskActivity{}).Error
+	})},
+	// the files of attachments can't be brought back, so they are only
+	// removed once the transaction has been committed
+	{"attachments", "task_id", "tasks", "id", "deleted with their files", func(tx *gorm.DB, ids []uint) (func(), error) {
+		var attachments []models.Attachment
+		if err := tx.Where("id IN ?", ids).Find(&attachments).Error; err != nil {
+			return nil, err
+		}
+		if err := tx.Where("id IN ?", ids).Delete(&models.Attachment{}).Error; err != nil {
+			return nil, err
+		}
+		return func() {
+			for _, attachment := range attachments {
+				removeAttachmentFile(attachment)
+			}
+		}, nil
+	}},
+}
+
+// rollbackOnly wraps a fix that only changes rows, which the transaction
+// takes back if a later repair fails
+func rollbackOnly(fix func(tx *gorm.DB, ids []uint) error) func(*gorm.DB, []uint) (func(), error) {
+	return func(tx *gorm.DB, ids []uint) (func(), error) {
+		return nil, fix(tx, ids)
+	}
+}
+
+// CheckIntegrity finds rows of every workspace that reference rows which
+// don't exist, as left behind before the foreign keys were in place. With
+// repair set they are deleted or unlinked, all in one transaction: if any
+// repair fails none is kept, no problem is marked repaired and the error is
+// returned.
+func CheckIntegrity(ctx context.Context, repair bool) ([]IntegrityProblem, error) {
+	var problems []IntegrityProblem
+	var afterCommit []func()
+	check := func(tx *gorm.DB) error {
+		problems = nil
+		for _, ref := range references {
+			var ids []uint
+			err := tx.Table(ref.table+" AS t").
+				Joins("LEFT JOIN "+ref.refTable+" AS r ON r."+ref.refColumn+" = t."+ref.column).
+				Where("t."+ref.column+" IS NOT NULL AND r."+ref.refColumn+" IS NULL").
+				Order("t.id").
+				Pluck("t.id", &ids).Error
+			if err != nil {
+				return err
+			}
+			if len(ids) == 0 {
+				continue
+			}
+			problem := IntegrityProblem{
+				Table:      ref.table,
+				Column:     ref.column,
+				References: ref.refTable,
+				IDs:        ids,
+				Repair:     ref.repair,
+			}
+			problems = append(problems, problem)
+			if repair {
+				done, err := ref.fix(tx, ids)
+				if err != nil {
+					return fmt.Errorf("repairing %s.%s: %w", ref.table, ref.column, err)
+				}
+				if done != nil {
+					afterCommit = append(afterCommit, done)
+				}
+				problems[len(problems)-1].Repaired = true
+			}
+		}
+		return nil
+	}
+
+	tx := database.For(ctx)
+	if !repair {
+		err := check(tx)
+		return problems, err
+	}
+	err := tx.Transaction(check)
+	if err != nil {
+		for i := range problems {
+			problems[i].Repaired = false
+		}
+		return problems, err
+	}
+	for _, done := range afterCommit {
+		done()
+	}
+	return problems, nil
+}
+
+func purgeTaskAssignments(tx *gorm.DB, ids []uint) error {
+	var assignments []models.TaskAssignment
+	if err := tx.Unscoped().Where("id IN ?", ids).Find(&assignments).Error; err != nil {
+		return err
+	}
+	for _, assignment := range assignments {
+		if err := purgeTaskAssignment(tx, assignment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
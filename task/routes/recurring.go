@@ -0,0 +1,380 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/saran-crayonte/task/database"
+	"github.com/saran-crayonte/task/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	FrequencyDaily   = "daily"
+	FrequencyWeekly  = "weekly"
+	FrequencyMonthly = "monthly"
+)
+
+// RecurrenceHorizon is how far ahead of today task instances are materialized
+var RecurrenceHorizon = 14 * 24 * time.Hour
+
+var weekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+func CreateTaskTemplate(c fiber.Ctx) error {
+	template := new(models.TaskTemplate)
+	if err := json.Unmarshal(c.Body(), &template); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	if msg := validateTemplate(db(c), template); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+	template.NextAssignee = 0
+	template.GeneratedThrough = ""
+	db(c).Create(&template)
+	return c.Status(fiber.StatusCreated).JSON(template)
+}
+
+func GetTaskTemplate(c fiber.Ctx) error {
+	template := new(models.TaskTemplate)
+	if err := json.Unmarshal(c.Body(), &template); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var existingTemplate models.TaskTemplate
+	db(c).First(&existingTemplate, template.ID)
+	if existingTemplate.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task template not found"})
+	}
+	return c.JSON(existingTemplate)
+}
+
+func UpdateTaskTemplate(c fiber.Ctx) error {
+	template := new(models.TaskTemplate)
+	if err := json.Unmarshal(c.Body(), &template); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var existingTemplate models.TaskTemplate
+	db(c).First(&existingTemplate, template.ID)
+	if existingTemplate.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task template not found"})
+	}
+	if msg := validateTemplate(db(c), template); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+
+	// instances that were already generated are left alone; the new rule
+	// applies from the next generator run onwards
+	template.NextAssignee = existingTemplate.NextAssignee
+	template.GeneratedThrough = existingTemplate.GeneratedThrough
+	db(c).Model(&existingTemplate).Select("*").Updates(template)
+	return c.JSON(template)
+}
+
+func DeleteTaskTemplate(c fiber.Ctx) error {
+	template := new(models.TaskTemplate)
+	if err := json.Unmarshal(c.Body(), &template); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var existingTemplate models.TaskTemplate
+	db(c).First(&existingTemplate, template.ID)
+	if existingTemplate.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task template not found"})
+	}
+	db(c).Delete(&existingTemplate)
+	return c.JSON(fiber.Map{
+		"message": "Task template deleted successfully",
+	})
+}
+
+// GenerateTaskTemplates runs the generator right away instead of waiting for
+// the next tick
+func GenerateTaskTemplates(c fiber.Ctx) error {
+	created := GenerateRecurringTasks(c.UserContext(), time.Now().Add(RecurrenceHorizon))
+	return c.JSON(fiber.Map{
+		"message": fmt.Sprintf("%d tasks generated", created),
+	})
+}
+
+// RunRecurringTaskGenerator materializes recurring tasks every interval
+// until the process exits
+func RunRecurringTaskGenerator(interval time.Duration) {
+	for {
+		created := GenerateRecurringTasks(database.WithActor(context.Background(), "system"), time.Now().Add(RecurrenceHorizon))
+		if created != 0 {
+			log.Printf("Generated %d recurring tasks", created)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// GenerateRecurringTasks creates the task instances of every template up to
+// and including through, and returns how many were created. Only templates
+// of the workspace in ctx are used; without one, those of every workspace.
+func GenerateRecurringTasks(ctx context.Context, through time.Time) int {
+	var templates []models.TaskTemplate
+	database.For(ctx).Find(&templates)
+
+	created := 0
+	for _, template := range templates {
+		generated := 0
+		// holding the template keeps generators running at the same time
+		// from handing out the same turn of the rotation twice
+		err := database.For(database.WithWorkspace(ctx, template.WorkspaceID)).Transaction(func(tx *gorm.DB) error {
+			var lockedTemplate models.TaskTemplate
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&lockedTemplate, template.ID).Error; err != nil {
+				return err
+			}
+			var err error
+			generated, err = generateFromTemplate(tx, lockedTemplate, through)
+			return err
+		})
+		if err != nil {
+			// the next run starts over from the same day
+			log.Printf("Recurring tasks of template %d not generated: %v", template.ID, err)
+			continue
+		}
+		created += generated
+	}
+	return created
+}
+
+func generateFromTemplate(tx *gorm.DB, template models.TaskTemplate, through time.Time) (int, error) {
+	start, err := time.Parse("2006-01-02", template.StartDate)
+	if err != nil {
+		return 0, nil
+	}
+	end := time.Date(through.Year(), through.Month(), through.Day(), 0, 0, 0, 0, time.UTC)
+	if template.Until != "" {
+		until, err := time.Parse("2006-01-02", template.Until)
+		if err == nil && until.Before(end) {
+			end = until
+		}
+	}
+	// instances are only materialized ahead of time, never backfilled
+	now := time.Now()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if day.Before(start) {
+		day = start
+	}
+	if template.GeneratedThrough != "" {
+		last, err := time.Parse("2006-01-02", template.GeneratedThrough)
+		if err == nil && !last.Before(day) {
+			day = last.AddDate(0, 0, 1)
+		}
+	}
+	if day.After(end) {
+		return 0, nil
+	}
+
+	var assignees []string
+	for _, username := range strings.Split(template.Assignees, ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			assignees = append(assignees, username)
+		}
+	}
+
+	created := 0
+	for ; !day.After(end); day = day.AddDate(0, 0, 1) {
+		if !occursOn(template, start, day) {
+			continue
+		}
+		dueDate := day.Format("2006-01-02")
+
+		var existingTask models.Task
+		// deleted instances count too, or they would come straight back
+		tx.Unscoped().Where("template_id = ? AND due_date = ?", template.ID, dueDate).First(&existingTask)
+		if existingTask.ID != 0 {
+			continue
+		}
+
+		templateID := template.ID
+		task := models.Task{
+			Title:          fmt.Sprintf("%s %s", template.Title, dueDate),
+			Status:         TaskStatusPending,
+			EstimatedHours: template.EstimatedHours,
+			TemplateID:     &templateID,
+			DueDate:        dueDate,
+		}
+		// a savepoint, so an instance created elsewhere doesn't abort the
+		// whole run
+		err := tx.Transaction(func(tx *gorm.DB) error {
+			return tx.Create(&task).Error
+		})
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		created++
+
+		if username, ok := nextAssignee(tx, &template, assignees); ok {
+			if err := assignRecurringTask(tx, task, username, day); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	err = tx.Model(&template).Updates(map[string]interface{}{
+		"generated_through": end.Format("2006-01-02"),
+		"next_assignee":     template.NextAssignee,
+	}).Error
+	if err != nil {
+		return 0, err
+	}
+	return created, nil
+}
+
+// nextAssignee takes the next turn of the template's round-robin. Users who
+// don't exist or are deactivated lose their turn; without anyone left, the
+// instance stays unassigned. The chosen user is held until the transaction
+// ends, so they can't be deactivated in between.
+func nextAssignee(tx *gorm.DB, template *models.TaskTemplate, assignees []string) (string, bool) {
+	for range assignees {
+		username := assignees[template.NextAssignee%len(assignees)]
+		template.NextAssignee = (template.NextAssignee + 1) % len(assignees)
+
+		var existingUser models.User
+		tx.Clauses(clause.Locking{Strength: "SHARE"}).First(&existingUser, "username = ?", username)
+		if existingUser.Active {
+			return existingUser.Username, true
+		}
+		log.Printf("Recurring tasks of template %d skip %q, who doesn't exist or is deactivated", template.ID, username)
+	}
+	return "", false
+}
+
+func assignRecurringTask(tx *gorm.DB, task models.Task, username string, day time.Time) error {
+	startDate := day.Add(9 * time.Hour)
+	result := calculateEndDate(tx, startDate, task.EstimatedHours)
+	return tx.Create(&models.TaskAssignment{
+		Username:   username,
+		TaskID:     task.ID,
+		Start_Date: startDate.Format("2006-01-02 3:04 PM"),
+		End_Date:   result.Format("2006-01-02 3:04 PM"),
+	}).Error
+}
+
+// occursOn reports whether the template's rule produces an instance on day.
+// Both dates are UTC midnight.
+func occursOn(template models.TaskTemplate, start, day time.Time) bool {
+	if day.Before(start) {
+		return false
+	}
+	interval := template.Interval
+	if interval < 1 {
+		interval = 1
+	}
+
+	switch template.Frequency {
+	case FrequencyDaily:
+		days := int(day.Sub(start).Hours() / 24)
+		return days%interval == 0
+
+	case FrequencyWeekly:
+		startWeek := start.AddDate(0, 0, -int(start.Weekday()))
+		dayWeek := day.AddDate(0, 0, -int(day.Weekday()))
+		weeks := int(dayWeek.Sub(startWeek).Hours() / (24 * 7))
+		if weeks%interval != 0 {
+			return false
+		}
+		days := parseByDay(template.ByDay)
+		if len(days) == 0 {
+			return day.Weekday() == start.Weekday()
+		}
+		for _, weekday := range days {
+			if day.Weekday() == weekday {
+				return true
+			}
+		}
+		return false
+
+	case FrequencyMonthly:
+		months := (day.Year()-start.Year())*12 + int(day.Month()) - int(start.Month())
+		if months%interval != 0 {
+			return false
+		}
+		days := parseByDay(template.ByDay)
+		if len(days) == 0 {
+			return day.Day() == start.Day()
+		}
+		if day.Weekday() != days[0] {
+			return false
+		}
+		if template.ByWeekNo < 0 {
+			return day.AddDate(0, 0, 7).Month() != day.Month()
+		}
+		return (day.Day()-1)/7+1 == template.ByWeekNo
+	}
+	return false
+}
+
+func parseByDay(byDay string) []time.Weekday {
+	var days []time.Weekday
+	for _, code := range strings.Split(byDay, ",") {
+		if weekday, ok := weekdays[strings.ToUpper(strings.TrimSpace(code))]; ok {
+			days = append(days, weekday)
+		}
+	}
+	return days
+}
+
+func validateTemplate(tx *gorm.DB, template *models.TaskTemplate) string {
+	if template.Title == "" {
+		return "title is required"
+	}
+	if template.EstimatedHours <= 0 {
+		return "estimatedHours must be positive"
+	}
+	if template.Interval == 0 {
+		template.Interval = 1
+	}
+	if template.Interval < 0 {
+		return "interval must be positive"
+	}
+	if _, err := time.Parse("2006-01-02", template.StartDate); err != nil {
+		return "invalid start date format"
+	}
+	if template.Until != "" {
+		if _, err := time.Parse("2006-01-02", template.Until); err != nil {
+			return "invalid until date format"
+		}
+	}
+	for _, code := range strings.Split(template.ByDay, ",") {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if _, ok := weekdays[code]; code != "" && !ok {
+			return "invalid weekday " + code
+		}
+	}
+
+	switch template.Frequency {
+	case FrequencyDaily, FrequencyWeekly:
+	case FrequencyMonthly:
+		if template.ByDay == "" {
+			break
+		}
+		if len(parseByDay(template.ByDay)) != 1 {
+			return "monthly rules take a single weekday"
+		}
+		if template.ByWeekNo == 0 || template.ByWeekNo < -1 || template.ByWeekNo > 5 {
+			return "byWeekNo must be 1 to 5, or -1 for the last week"
+		}
+	default:
+		return "frequency must be daily, weekly or monthly"
+	}
+	return ""
+}
@@ -2,40 +2,118 @@ package routes
 
 import (
 	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/requestid"
 	"github.com/saran-crayonte/task/database"
 	"github.com/saran-crayonte/task/models"
 	"github.com/saran-crayonte/task/user"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 func SetupRoutes(app *fiber.App) {
 
-	ap := app.Group("/api")
+	ap := app.Group("/api", requestid.New(), withRequestID)
 	ap.Post("/user", user.Register())
 	ap.Post("/user/login", user.Login())
+	ap.Post("/user/login/mfa", user.LoginMFA())
+	ap.Get("/user/oidc/login", user.OIDCLogin())
+	ap.Get("/user/oidc/callback", user.OIDCCallback())
+	ap.Post("/user/refresh", user.RefreshToken())
+	ap.Post("/user/password/reset", user.RequestPasswordReset())
+	ap.Post("/user/password/reset/confirm", user.ConfirmPasswordReset())
+	ap.Post("/user/email/verify", user.VerifyEmail())
+	ap.Post("/user/email/resend", user.ResendVerification())
 
 	api := ap.Group("/v2", user.Authenticate())
 
-	api.Get("/refreshToken", user.RefreshToken())
+	admins := user.Authorize(models.RoleAdmin)
+	managers := user.Authorize(models.RoleAdmin, models.RoleManager)
+	members := user.Authorize(models.RoleAdmin, models.RoleManager, models.RoleMember)
 
-	api.Put("/user", user.UpdatePassword())
+	api.Get("/workspace", user.GetWorkspace())
+	api.Post("/workspace/user", user.AddWorkspaceUser(), admins)
 
-	api.Post("/task", CreateTasks)
+	api.Put("/user", user.UpdatePassword())
+	api.Get("/user/profile", user.GetProfile())
+	api.Put("/user/profile", user.UpdateProfile())
+	api.Patch("/user/profile", user.UpdateProfile())
+	api.Post("/user/logout", user.Logout())
+	api.Post("/user/logoutAll", user.LogoutAll())
+	api.Put("/user/role", user.UpdateRole(), admins)
+	api.Post("/user/unlock", user.UnlockUser(), admins)
+	api.Post("/user/deactivate", DeactivateUser, admins)
+	api.Post("/user/reactivate", ReactivateUser, admins)
+	api.Post("/user/email/resend", user.AdminResendVerification(), admins)
+	api.Post("/user/email/forceVerify", user.ForceVerifyEmail(), admins)
+	api.Post("/user/mfa/enroll", user.EnrollMFA())
+	api.Post("/user/mfa/verify", user.VerifyMFA())
+	api.Post("/user/mfa/disable", user.DisableMFA())
+	api.Post("/user/apiKey", user.CreateAPIKey())
+	api.Get("/user/apiKey", user.GetAPIKeys())
+	api.Delete("/user/apiKey/id", user.RevokeAPIKey())
+
+	api.Post("/task", CreateTasks, managers)
 	api.Get("/task/id", GetTasks)
-	api.Put("/task/id", UpdateTasks)
-	api.Delete("/task/id", DeleteTasks)
-
-	api.Post("/taskAssignment", CreateTaskAssignment)
+	api.Put("/task/id", UpdateTasks, managers)
+	api.Delete("/task/id", DeleteTasks, managers)
+	api.Post("/task/restore", RestoreTask, managers)
+	api.Get("/task/tree", GetTaskTree)
+	api.Get("/task/activity", GetTaskActivity)
+	api.Get("/task/effort", GetTaskEffort)
+
+	api.Post("/task/attachment", UploadAttachment, members)
+	api.Get("/task/attachment", GetAttachments)
+	api.Get("/task/attachment/id", DownloadAttachment)
+	api.Delete("/task/attachment/id", DeleteAttachment, members)
+
+	api.Post("/comment", CreateComment, members)
+	api.Get("/comment", GetComments)
+	api.Put("/comment/id", UpdateComment, members)
+	api.Delete("/comment/id", DeleteComment, members)
+
+	api.Post("/taskAssignment", CreateTaskAssignment, members)
 	api.Get("/taskAssignment/id", GetTaskAssignment)
-	api.Put("/taskAssignment/id", UpdateTaskAssignment)
-	api.Delete("/taskAssignment/id", DeleteTaskAssignment)
-
-	api.Post("/holiday", CreateHoliday)
+	api.Put("/taskAssignment/id", UpdateTaskAssignment, members)
+	api.Delete("/taskAssignment/id", DeleteTaskAssignment, members)
+	api.Post("/taskAssignment/restore", RestoreTaskAssignment, members)
+	api.Post("/taskAssignment/reschedule", RescheduleTaskAssignment, managers)
+	api.Get("/taskAssignment/flagged", GetFlaggedTaskAssignments, managers)
+
+	api.Post("/timeEntry", CreateTimeEntry, members)
+	api.Get("/timeEntry", GetTimeEntries)
+	api.Delete("/timeEntry/id", DeleteTimeEntry, members)
+	api.Post("/timeEntry/start", StartTimer, members)
+	api.Post("/timeEntry/stop", StopTimer, members)
+
+	api.Post("/taskTemplate", CreateTaskTemplate, managers)
+	api.Get("/taskTemplate/id", GetTaskTemplate)
+	api.Put("/taskTemplate/id", UpdateTaskTemplate, managers)
+	api.Delete("/taskTemplate/id", DeleteTaskTemplate, managers)
+	api.Post("/taskTemplate/generate", GenerateTaskTemplates, managers)
+
+	api.Post("/team", CreateTeam, admins)
+	api.Get("/team/id", GetTeam)
+	api.Put("/team/id", UpdateTeam, admins)
+	api.Delete("/team/id", DeleteTeam, admins)
+	api.Post("/team/member", AddTeamMember, admins)
+	api.Delete("/team/member", RemoveTeamMember, admins)
+	api.Get("/team/assignments", GetTeamAssignments)
+	api.Get("/team/workload", GetTeamWorkload)
+
+	api.Get("/audit", GetAuditLog, admins)
+
+	api.Post("/holiday", CreateHoliday, admins)
 	api.Get("/holiday/id", GetHoliday)
-	api.Put("/holiday/id", UpdateHoliday)
-	api.Delete("/holiday/id", DeleteHoliday)
+	api.Put("/holiday/id", UpdateHoliday, admins)
+	api.Delete("/holiday/id", DeleteHoliday, admins)
+	api.Post("/holiday/restore", RestoreHoliday, admins)
+
+	api.Get("/trash", GetTrash, managers)
+	api.Post("/trash/purge", PurgeTrash, admins)
 
 	// api.Post("/user", CreateUser)
 	// api.Post("/user/login", LoginUser)
@@ -48,14 +126,39 @@ func CreateTasks(c fiber.Ctx) error {
 	if err := json.Unmarshal(c.Body(), &task); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
 	}
+	// subtasks are attached through their own parentId, never by sending
+	// them along with the parent
+	task.Children = nil
+	// the id, version and deletion of a row are the server's to set
+	task.ID, task.Version, task.DeletedAt = 0, 0, gorm.DeletedAt{}
 
 	var existingTask models.Task
-	database.DB.Where("title = ?", task.Title).First(&existingTask)
+	db(c).Where("title = ?", task.Title).First(&existingTask)
 	if existingTask.ID != 0 {
 		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Task with the same title already exists"})
 	}
 
-	database.DB.Create(&task)
+	if task.ParentID != nil {
+		var parent models.Task
+		db(c).First(&parent, *task.ParentID)
+		if parent.ID == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Parent task not found"})
+		}
+	}
+
+	err := db(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&task).Error; err != nil {
+			return err
+		}
+		if task.ParentID != nil {
+			return rollupTask(tx, *task.ParentID)
+		}
+		return nil
+	})
+	if err != nil {
+		return transactionError(c, err, "task could not be created")
+	}
+	setETag(c, task.Version)
 	return c.Status(fiber.StatusCreated).JSON(task)
 }
 
@@ -65,10 +168,11 @@ func GetTasks(c fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
 	}
 	var newTask models.Task
-	database.DB.First(&newTask, task.ID)
+	db(c).First(&newTask, task.ID)
 	if newTask.ID == 0 {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task not found"})
 	}
+	setETag(c, newTask.Version)
 	return c.Status(fiber.StatusOK).JSON(newTask)
 }
 func UpdateTasks(c fiber.Ctx) error {
@@ -77,19 +181,83 @@ func UpdateTasks(c fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
 
 	}
+	task.Children = nil
+	// a parentId of null moves the task back to the top level, while
+	// leaving the key out keeps its parent
+	var keys map[string]json.RawMessage
+	json.Unmarshal(c.Body(), &keys)
+	detach := task.ParentID == nil && string(keys["parentId"]) == "null"
 
 	var existingTask models.Task
-	database.DB.First(&existingTask, task.ID)
+	db(c).First(&existingTask, task.ID)
 	if existingTask.ID == 0 {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task not found"})
 	}
+	if !ifMatch(c, existingTask.Version) {
+		return preconditionFailed(c, "Task")
+	}
 
 	// newData := new(models.Task)
 	// if err := json.Unmarshal(c.Body(), &newData); err != nil {
 	// 	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
 	// }
 
-	database.DB.Model(&existingTask).Updates(task)
+	oldParentID := existingTask.ParentID
+	oldStatus := existingTask.Status
+	oldEstimatedHours := existingTask.EstimatedHours
+	if task.ParentID != nil {
+		var parent models.Task
+		db(c).First(&parent, *task.ParentID)
+		if parent.ID == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Parent task not found"})
+		}
+		if isDescendant(db(c), existingTask.ID, parent.ID) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Task cannot be moved under its own subtask"})
+		}
+	}
+
+	// only write over the version that was read, another write may have
+	// slipped in since
+	task.Version = existingTask.Version + 1
+	err := db(c).Transaction(func(tx *gorm.DB) error {
+		update := tx.Model(&existingTask).Where("version = ?", existingTask.Version).Omit("DeletedAt")
+		if detach {
+			// Updates skips nil fields, so the cleared parent has to be named
+			update = update.Select(append(nonZeroFields(tx, task), "ParentID"))
+		}
+		updated := update.Updates(task)
+		if updated.Error != nil {
+			return updated.Error
+		}
+		if updated.RowsAffected == 0 {
+			return staleError("Task")
+		}
+
+		// a parent's hours and status come from its children, so recompute
+		// it and everything above it
+		for _, id := range []*uint{&existingTask.ID, oldParentID, task.ParentID} {
+			if id == nil {
+				continue
+			}
+			if err := rollupTask(tx, *id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return transactionError(c, err, "task could not be updated")
+	}
+	// the rollup records its own status changes, this is the caller's
+	if task.Status != "" {
+		recordActivity(c, existingTask.ID, ActivityStatus, oldStatus, task.Status)
+	}
+	db(c).First(&existingTask, existingTask.ID)
+	// the end dates of the assignments were worked out from the old estimate
+	if existingTask.EstimatedHours != oldEstimatedHours {
+		rescheduleAssignments(db(c), existingTask)
+	}
+	setETag(c, existingTask.Version)
 	return c.Status(fiber.StatusOK).JSON(existingTask)
 
 }
@@ -98,13 +266,80 @@ func DeleteTasks(c fiber.Ctx) error {
 	if err := json.Unmarshal(c.Body(), &task); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
 	}
-	var newTask models.Task
-	database.DB.First(&newTask, task.ID)
-	if newTask.ID == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task not found"})
-	}
+	policy := c.Query("policy", TaskDeletePolicy)
+	assignmentPolicy := c.Query("assignments", TaskAssignmentDeletePolicy)
+
+	var unassigned []models.TaskAssignment
+	err := db(c).Transaction(func(tx *gorm.DB) error {
+		// holding the task keeps assignments from being added while it goes
+		var newTask models.Task
+		tx.Clauses(clause.Locking{Strength: "NO KEY UPDATE"}).First(&newTask, task.ID)
+		if newTask.ID == 0 {
+			return fiber.NewError(fiber.StatusNotFound, "Task not found")
+		}
+		if !ifMatch(c, newTask.Version) {
+			return staleError("Task")
+		}
 
-	database.DB.Delete(&newTask)
+		var childCount int64
+		tx.Model(&models.Task{}).Where("parent_id = ?", newTask.ID).Count(&childCount)
+		if childCount != 0 {
+			switch policy {
+			case DeletePolicyReject:
+				return fiber.NewError(fiber.StatusConflict, "Task has subtasks")
+			case DeletePolicyOrphan, DeletePolicyCascade:
+			default:
+				return fiber.NewError(fiber.StatusBadRequest, "invalid delete policy")
+			}
+		}
+
+		ids := []uint{newTask.ID}
+		if policy == DeletePolicyCascade {
+			ids = taskSubtree(tx, newTask.ID)
+		}
+		var assignments []models.TaskAssignment
+		tx.Where("task_id IN ?", ids).Find(&assignments)
+		switch assignmentPolicy {
+		case AssignmentPolicyReject:
+			if len(assignments) != 0 {
+				return fiber.NewError(fiber.StatusConflict, "Task has assignments")
+			}
+		case AssignmentPolicyCascade, AssignmentPolicyUnassign:
+		default:
+			return fiber.NewError(fiber.StatusBadRequest, "invalid assignments policy")
+		}
+
+		if childCount != 0 && policy == DeletePolicyOrphan {
+			tx.Model(&models.Task{}).Where("parent_id = ?", newTask.ID).Updates(bumped(map[string]interface{}{"parent_id": nil}))
+		}
+		// everything deleted here shares one timestamp so a restore can tell
+		// what went together
+		now := time.Now().Truncate(time.Microsecond)
+		deleting := tx.Session(&gorm.Session{NowFunc: func() time.Time { return now }})
+		// unassigned assignments go to the trash a moment earlier, so
+		// restoring the task leaves them out while they can still be
+		// restored on their own, time entries and all
+		unassigning := tx.Session(&gorm.Session{NowFunc: func() time.Time { return now.Add(-time.Microsecond) }})
+		for _, assignment := range assignments {
+			if assignmentPolicy == AssignmentPolicyUnassign {
+				unassigning.Delete(&assignment)
+				unassigned = append(unassigned, assignment)
+			} else {
+				deleting.Delete(&assignment)
+			}
+		}
+		deleteSubtree(deleting, newTask)
+		if newTask.ParentID != nil {
+			return rollupTask(tx, *newTask.ParentID)
+		}
+		return nil
+	})
+	if err != nil {
+		return transactionError(c, err, "task could not be deleted")
+	}
+	for _, assignment := range unassigned {
+		recordActivity(c, assignment.TaskID, ActivityAssignment, assignment.Username, "")
+	}
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"message": "Task deleted successfully",
 	})
@@ -115,65 +350,128 @@ func CreateTaskAssignment(c fiber.Ctx) error {
 	if err := json.Unmarshal(c.Body(), &taskAssignment); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
 	}
-	var existingUser models.User
-	database.DB.First(&existingUser, "username = ?", taskAssignment.Username)
-	if len(existingUser.Username) == 0 {
-		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Username doesn't exists"})
-	}
-
-	var existingTask models.Task
-	database.DB.First(&existingTask, taskAssignment.TaskID)
-	if existingTask.ID == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task not found"})
+	if !canAssign(c, taskAssignment.Username) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You can only assign tasks to yourself or your team"})
 	}
-
-	//to check if task already assigned
-	var checkAlreadyAssigned models.TaskAssignment
-	database.DB.First(&checkAlreadyAssigned, taskAssignment.TaskID)
-	if checkAlreadyAssigned.ID != 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task is already assigned to somebody"})
-	}
-
-	estimatedHours := existingTask.EstimatedHours
+	taskAssignment.ID, taskAssignment.Version, taskAssignment.DeletedAt = 0, 0, gorm.DeletedAt{}
 	layout := "2006-01-02 3:04 PM"
 	startDate, err := time.Parse(layout, taskAssignment.Start_Date)
 	// startDate, err := time.Parse(time.RFC3339, taskAssignment.Start_Date)
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid date time format"})
 	}
-	result := calculateEndDate(startDate, estimatedHours)
-	/*
-		startDate, err := time.Parse("2006-01-02", taskAssignment.Start_Date)
+
+	// the checks and the insert share a transaction that holds the user and
+	// the task, so a deactivation, deletion or second assignment running at
+	// the same time either finishes first or waits for this one
+	err = db(c).Transaction(func(tx *gorm.DB) error {
+		var existingUser models.User
+		tx.Clauses(clause.Locking{Strength: "SHARE"}).First(&existingUser, "username = ?", taskAssignment.Username)
+		if len(existingUser.Username) == 0 {
+			return fiber.NewError(fiber.StatusConflict, "Username doesn't exists")
+		}
+		if !existingUser.Active {
+			return fiber.NewError(fiber.StatusConflict, "User is deactivated")
+		}
+
+		existingTask, err := lockUnassignedTask(tx, taskAssignment.TaskID, 0)
 		if err != nil {
 			return err
 		}
 
-		startDate = startDate.Truncate(24 * time.Hour)
+		result := calculateEndDate(tx, startDate, existingTask.EstimatedHours)
+		taskAssignment.Start_Date = startDate.Format("2006-01-02 3:04 PM")
+		taskAssignment.End_Date = result.Format("2006-01-02 3:04 PM")
+		return assignmentError(tx.Create(taskAssignment).Error)
+	})
+	if err != nil {
+		return transactionError(c, err, "assignment could not be created")
+	}
+	recordActivity(c, taskAssignment.TaskID, ActivityAssignment, "", taskAssignment.Username)
+	setETag(c, taskAssignment.Version)
+	return c.JSON(taskAssignment)
+}
 
-		for hours := estimatedHours; hours > 0; {
-			if startDate.Weekday() == time.Saturday ||
-				startDate.Weekday() == time.Sunday ||
-				isHoliday(startDate) {
-				startDate = startDate.AddDate(0, 0, 1)
-				continue
-			}
-			hours -= 8
-			startDate = startDate.AddDate(0, 0, 1)
+// lockUnassignedTask locks the task against concurrent assignment changes and
+// checks that no live assignment other than except holds it
+func lockUnassignedTask(tx *gorm.DB, taskID, except uint) (models.Task, error) {
+	var task models.Task
+	tx.Clauses(clause.Locking{Strength: "NO KEY UPDATE"}).First(&task, taskID)
+	if task.ID == 0 {
+		return task, fiber.NewError(fiber.StatusNotFound, "Task not found")
+	}
+
+	//to check if task already assigned
+	var assignedCount int64
+	if err := tx.Model(&models.TaskAssignment{}).Where("task_id = ? AND id <> ?", task.ID, except).Count(&assignedCount).Error; err != nil {
+		return task, err
+	}
+	if assignedCount != 0 {
+		return task, fiber.NewError(fiber.StatusConflict, "Task is already assigned to somebody")
+	}
+	return task, nil
+}
+
+// assignmentError answers a write to an assignment that the unique index on
+// live assignments caught after it slipped past lockUnassignedTask
+func assignmentError(err error) error {
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return fiber.NewError(fiber.StatusConflict, "Task is already assigned to somebody")
+	}
+	return err
+}
+
+// db is the database session of a request. It only sees the caller's
+// workspace.
+func db(c fiber.Ctx) *gorm.DB {
+	return database.For(c.UserContext())
+}
+
+// transactionError answers a request whose transaction was rolled back. A
+// *fiber.Error returned from the transaction carries the response; any
+// other error is answered with message.
+func transactionError(c fiber.Ctx, err error, message string) error {
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		return c.Status(fiberErr.Code).JSON(fiber.Map{"error": fiberErr.Message})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": message})
+}
+
+// canAssign reports whether the caller may create or change an assignment
+// for username; admins can manage anyone's, everybody else their own and,
+// as team leads, those of the people in their teams
+func canAssign(c fiber.Ctx, username string) bool {
+	if user.HasRole(c, models.RoleAdmin) {
+		return true
+	}
+	caller, _ := c.Locals("username").(string)
+	return caller == username || leadsTeamOf(db(c), caller, username)
+}
+
+// rescheduleAssignments recomputes the end dates of the task's assignments
+// from their start dates and the task's current estimate
+func rescheduleAssignments(tx *gorm.DB, task models.Task) {
+	var assignments []models.TaskAssignment
+	tx.Where("task_id = ?", task.ID).Find(&assignments)
+	for _, assignment := range assignments {
+		startDate, err := time.Parse("2006-01-02 3:04 PM", assignment.Start_Date)
+		if err != nil {
+			continue
 		}
-	*/
-	taskAssignment.Start_Date = startDate.Format("2006-01-02 3:04 PM")
-	taskAssignment.End_Date = result.Format("2006-01-02 3:04 PM")
-	database.DB.Create(taskAssignment)
-	return c.JSON(taskAssignment)
+		endDate := calculateEndDate(tx, startDate, task.EstimatedHours).Format("2006-01-02 3:04 PM")
+		tx.Model(&assignment).Updates(bumped(map[string]interface{}{"end_date": endDate}))
+	}
 }
-func calculateEndDate(startDate time.Time, estimatedHours int) time.Time {
+
+func calculateEndDate(tx *gorm.DB, startDate time.Time, estimatedHours int) time.Time {
 	//workingHoursPerDay := 8
 	endDate := startDate
 	remainingHours := estimatedHours
 
 	for remainingHours > 0 {
 
-		if endDate.Weekday() == time.Saturday || endDate.Weekday() == time.Sunday || isHoliday(endDate) {
+		if endDate.Weekday() == time.Saturday || endDate.Weekday() == time.Sunday || isHoliday(tx, endDate) {
 			endDate = endDate.AddDate(0, 0, 1)
 			continue
 		}
@@ -198,9 +496,9 @@ func calculateEndDate(startDate time.Time, estimatedHours int) time.Time {
 
 	return endDate
 }
-func isHoliday(date time.Time) bool {
+func isHoliday(tx *gorm.DB, date time.Time) bool {
 	holiday := new(models.Holiday)
-	if err := database.DB.Where("holiday_date = ?", date.Format("2006-01-02")).First(holiday).Error; err != nil {
+	if err := tx.Where("holiday_date = ?", date.Format("2006-01-02")).First(holiday).Error; err != nil {
 		return false
 	}
 	return true
@@ -212,10 +510,11 @@ func GetTaskAssignment(c fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
 	}
 	var newTaskAssignment models.TaskAssignment
-	database.DB.First(&newTaskAssignment, taskAssignment.ID)
+	db(c).First(&newTaskAssignment, taskAssignment.ID)
 	if newTaskAssignment.ID == 0 {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task Assignment not found"})
 	}
+	setETag(c, newTaskAssignment.Version)
 	return c.JSON(newTaskAssignment)
 }
 
@@ -224,43 +523,71 @@ func UpdateTaskAssignment(c fiber.Ctx) error {
 	if err := json.Unmarshal(c.Body(), &taskAssignment); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
 	}
-	var existingUser models.User
-	database.DB.First(&existingUser, "username = ?", taskAssignment.Username)
-	if len(existingUser.Username) == 0 {
-		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Username doesn't exists"})
+	if !canAssign(c, taskAssignment.Username) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You can only assign tasks to yourself or your team"})
 	}
-
-	var existingTask models.Task
-	database.DB.First(&existingTask, taskAssignment.TaskID)
-	if existingTask.ID == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task not found"})
-	}
-
-	//to check if task already assigned
-	var checkAlreadyAssigned models.TaskAssignment
-	database.DB.First(&checkAlreadyAssigned, taskAssignment.TaskID)
-	if checkAlreadyAssigned.ID != 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task is already assigned to somebody"})
-	}
-
-	estimatedHours := existingTask.EstimatedHours
 	layout := "2006-01-02 3:04 PM"
 	startDate, err := time.Parse(layout, taskAssignment.Start_Date)
 	// startDate, err := time.Parse(time.RFC3339, taskAssignment.Start_Date)
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid date time format"})
 	}
-	result := calculateEndDate(startDate, estimatedHours)
-	taskAssignment.Start_Date = startDate.Format("2006-01-02 3:04 PM")
-	taskAssignment.End_Date = result.Format("2006-01-02 3:04 PM")
 
+	// like CreateTaskAssignment, the checks and the write share a
+	// transaction that holds the user and the task
 	var existingTaskAssignment models.TaskAssignment
-	database.DB.First(&existingTaskAssignment, taskAssignment.ID)
-	if existingTaskAssignment.ID == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task Assignment not found"})
-	}
+	var oldUsername string
+	err = db(c).Transaction(func(tx *gorm.DB) error {
+		var existingUser models.User
+		tx.Clauses(clause.Locking{Strength: "SHARE"}).First(&existingUser, "username = ?", taskAssignment.Username)
+		if len(existingUser.Username) == 0 {
+			return fiber.NewError(fiber.StatusConflict, "Username doesn't exists")
+		}
+		if !existingUser.Active {
+			return fiber.NewError(fiber.StatusConflict, "User is deactivated")
+		}
+
+		existingTask, err := lockUnassignedTask(tx, taskAssignment.TaskID, taskAssignment.ID)
+		if err != nil {
+			return err
+		}
 
-	database.DB.Model(&existingTaskAssignment).Updates(taskAssignment)
+		tx.First(&existingTaskAssignment, taskAssignment.ID)
+		if existingTaskAssignment.ID == 0 {
+			return fiber.NewError(fiber.StatusNotFound, "Task Assignment not found")
+		}
+		if !canAssign(c, existingTaskAssignment.Username) {
+			return fiber.NewError(fiber.StatusForbidden, "You can only change assignments of yourself or your team")
+		}
+		if !ifMatch(c, existingTaskAssignment.Version) {
+			return staleError("Task Assignment")
+		}
+
+		result := calculateEndDate(tx, startDate, existingTask.EstimatedHours)
+		taskAssignment.Start_Date = startDate.Format("2006-01-02 3:04 PM")
+		taskAssignment.End_Date = result.Format("2006-01-02 3:04 PM")
+
+		oldUsername = existingTaskAssignment.Username
+		needsReassignment := existingTaskAssignment.NeedsReassignment
+		taskAssignment.Version = existingTaskAssignment.Version + 1
+		updated := tx.Model(&existingTaskAssignment).Where("version = ?", existingTaskAssignment.Version).Omit("DeletedAt").Updates(taskAssignment)
+		if updated.Error != nil {
+			return assignmentError(updated.Error)
+		}
+		if updated.RowsAffected == 0 {
+			return staleError("Task Assignment")
+		}
+		if needsReassignment && taskAssignment.Username != oldUsername {
+			return tx.Model(&existingTaskAssignment).Updates(bumped(map[string]interface{}{"needs_reassignment": false})).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return transactionError(c, err, "assignment could not be updated")
+	}
+	recordActivity(c, existingTaskAssignment.TaskID, ActivityAssignment, oldUsername, existingTaskAssignment.Username)
+	db(c).First(&existingTaskAssignment, existingTaskAssignment.ID)
+	setETag(c, existingTaskAssignment.Version)
 	return c.JSON(existingTaskAssignment)
 }
 
@@ -271,12 +598,21 @@ func DeleteTaskAssignment(c fiber.Ctx) error {
 	}
 
 	var existingTaskAssignment models.TaskAssignment
-	database.DB.First(&existingTaskAssignment, taskAssignment.ID)
+	db(c).First(&existingTaskAssignment, taskAssignment.ID)
 	if existingTaskAssignment.ID == 0 {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task Assignment not found"})
 	}
+	if !canAssign(c, existingTaskAssignment.Username) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You can only change assignments of yourself or your team"})
+	}
+	if !ifMatch(c, existingTaskAssignment.Version) {
+		return preconditionFailed(c, "Task Assignment")
+	}
 
-	database.DB.Delete(&existingTaskAssignment)
+	if db(c).Where("version = ?", existingTaskAssignment.Version).Delete(&existingTaskAssignment).RowsAffected == 0 {
+		return preconditionFailed(c, "Task Assignment")
+	}
+	recordActivity(c, existingTaskAssignment.TaskID, ActivityAssignment, existingTaskAssignment.Username, "")
 	return c.JSON(fiber.Map{
 		"message": "Task Assignment entry deleted successfully",
 	})
@@ -288,11 +624,13 @@ func CreateHoliday(c fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
 	}
 	var newHoliday models.Holiday
-	database.DB.First(&newHoliday, holiday.HolidayDate)
+	db(c).First(&newHoliday, holiday.HolidayDate)
 	if newHoliday.ID != 0 {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Holiday already defined"})
 	}
-	database.DB.Create(&holiday)
+	holiday.ID, holiday.Version, holiday.DeletedAt = 0, 0, gorm.DeletedAt{}
+	db(c).Create(&holiday)
+	setETag(c, holiday.Version)
 	return c.Status(fiber.StatusCreated).JSON(holiday)
 }
 func GetHoliday(c fiber.Ctx) error {
@@ -301,10 +639,11 @@ func GetHoliday(c fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
 	}
 	var newHoliday models.Holiday
-	database.DB.First(&newHoliday, holiday.ID)
+	db(c).First(&newHoliday, holiday.ID)
 	if newHoliday.ID == 0 {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Holiday not found"})
 	}
+	setETag(c, newHoliday.Version)
 	return c.JSON(newHoliday)
 }
 func UpdateHoliday(c fiber.Ctx) error {
@@ -313,11 +652,19 @@ func UpdateHoliday(c fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
 	}
 	var newHoliday models.Holiday
-	database.DB.First(&newHoliday, holiday.ID)
+	db(c).First(&newHoliday, holiday.ID)
 	if newHoliday.ID == 0 {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Holiday not found"})
 	}
-	database.DB.Model(&newHoliday).Updates(holiday)
+	if !ifMatch(c, newHoliday.Version) {
+		return preconditionFailed(c, "Holiday")
+	}
+	holiday.Version = newHoliday.Version + 1
+	if db(c).Model(&newHoliday).Where("version = ?", newHoliday.Version).Omit("DeletedAt").Updates(holiday).RowsAffected == 0 {
+		return preconditionFailed(c, "Holiday")
+	}
+	db(c).First(&newHoliday, newHoliday.ID)
+	setETag(c, newHoliday.Version)
 	return c.JSON(newHoliday)
 }
 func DeleteHoliday(c fiber.Ctx) error {
@@ -326,11 +673,16 @@ func DeleteHoliday(c fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
 	}
 	var newHoliday models.Holiday
-	database.DB.First(&newHoliday, holiday.ID)
+	db(c).First(&newHoliday, holiday.ID)
 	if newHoliday.ID == 0 {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Holiday not found"})
 	}
-	database.DB.Delete(&newHoliday)
+	if !ifMatch(c, newHoliday.Version) {
+		return preconditionFailed(c, "Holiday")
+	}
+	if db(c).Where("version = ?", newHoliday.Version).Delete(&newHoliday).RowsAffected == 0 {
+		return preconditionFailed(c, "Holiday")
+	}
 	return c.JSON(fiber.Map{
 		"message": "Holiday deleted successfully",
 	})
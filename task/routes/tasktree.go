@@ -0,0 +1,183 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/saran-crayonte/task/database"
+	"github.com/saran-crayonte/task/models"
+	"gorm.io/gorm"
+)
+
+const (
+	TaskStatusPending    = "pending"
+	TaskStatusInProgress = "inprogress"
+	TaskStatusCompleted  = "completed"
+)
+
+// What happens to the children of a task when the task is deleted
+const (
+	DeletePolicyCascade = "cascade"
+	DeletePolicyOrphan  = "orphan"
+	DeletePolicyReject  = "reject"
+)
+
+// TaskDeletePolicy is used when the delete request doesn't pass ?policy=
+var TaskDeletePolicy = DeletePolicyReject
+
+func GetTaskTree(c fiber.Ctx) error {
+	task := new(models.Task)
+	if err := json.Unmarshal(c.Body(), &task); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var root models.Task
+	db(c).First(&root, task.ID)
+	if root.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task not found"})
+	}
+	loadChildren(db(c), &root)
+	return c.Status(fiber.StatusOK).JSON(root)
+}
+
+func loadChildren(tx *gorm.DB, task *models.Task) {
+	tx.Where("parent_id = ?", task.ID).Order("id").Find(&task.Children)
+	for i := range task.Children {
+		loadChildren(tx, &task.Children[i])
+	}
+}
+
+// isDescendant reports whether candidate sits somewhere below task in the tree,
+// which would make a cycle if task were re-parented under it
+func isDescendant(tx *gorm.DB, taskID, candidateID uint) bool {
+	for id := candidateID; id != 0; {
+		if id == taskID {
+			return true
+		}
+		var t models.Task
+		tx.First(&t, id)
+		if t.ParentID == nil {
+			return false
+		}
+		id = *t.ParentID
+	}
+	return false
+}
+
+// rollupTask recomputes EstimatedHours and Status of a parent task from its
+// children and walks up to the root. A task without children keeps its own
+// values, which also goes for a parent whose last child just left. Status
+// changes go to the activity feed under the actor of tx.
+func rollupTask(tx *gorm.DB, id uint) error {
+	for id != 0 {
+		var parent models.Task
+		err := tx.First(&parent, id).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var children []models.Task
+		if err := tx.Where("parent_id = ?", parent.ID).Find(&children).Error; err != nil {
+			return err
+		}
+		if len(children) != 0 {
+			hours := 0
+			for _, child := range children {
+				hours += child.EstimatedHours
+			}
+			oldStatus, status := parent.Status, deriveStatus(children)
+			err := tx.Model(&parent).Updates(bumped(map[string]interface{}{
+				"estimated_hours": hours,
+				"status":          status,
+			})).Error
+			if err != nil {
+				return err
+			}
+			if status != oldStatus {
+				err := tx.Create(&models.TaskActivity{
+					TaskID: parent.ID,
+					Actor:  database.ActorFrom(tx.Statement.Context),
+					Kind:   ActivityStatus,
+					From:   oldStatus,
+					To:     status,
+				}).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if parent.ParentID == nil {
+			return nil
+		}
+		id = *parent.ParentID
+	}
+	return nil
+}
+
+func deriveStatus(children []models.Task) string {
+	pending, completed := 0, 0
+	for _, child := range children {
+		switch strings.ToLower(child.Status) {
+		case TaskStatusPending:
+			pending++
+		case TaskStatusCompleted:
+			completed++
+		}
+	}
+	switch {
+	case completed == len(children):
+		return TaskStatusCompleted
+	case pending == len(children):
+		return TaskStatusPending
+	default:
+		return TaskStatusInProgress
+	}
+}
+
+// deleteSubtree soft-deletes the task and everything below it. Comments,
+// attachments and activity stay until the task is purged from the trash.
+func deleteSubtree(tx *gorm.DB, task models.Task) {
+	var children []models.Task
+	tx.Where("parent_id = ?", task.ID).Find(&children)
+	for _, child := range children {
+		deleteSubtree(tx, child)
+	}
+	tx.Delete(&task)
+}
+
+// taskSubtree returns the ids of the task and all of its live descendants
+func taskSubtree(tx *gorm.DB, id uint) []uint {
+	ids := []uint{id}
+	for queue := ids; len(queue) != 0; {
+		var children []uint
+		tx.Model(&models.Task{}).Where("parent_id IN ?", queue).Pluck("id", &children)
+		ids = append(ids, children...)
+		queue = children
+	}
+	return ids
+}
+
+// nonZeroFields names the fields of model that hold a value, which are the
+// ones Updates writes
+func nonZeroFields(tx *gorm.DB, model interface{}) []string {
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(model); err != nil {
+		return nil
+	}
+	value := reflect.Indirect(reflect.ValueOf(model))
+	var fields []string
+	for _, field := range stmt.Schema.Fields {
+		if field.DBName == "" || field.PrimaryKey {
+			continue
+		}
+		if _, zero := field.ValueOf(tx.Statement.Context, value); !zero {
+			fields = append(fields, field.Name)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,352 @@
+package routes
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/saran-crayonte/task/models"
+	"github.com/saran-crayonte/task/user"
+	"gorm.io/gorm"
+)
+
+// MemberWorkload sums up the open work of one user. AvailableFrom is when
+// their last open assignment ends, or empty if they have none.
+type MemberWorkload struct {
+	Username        string `json:"username"`
+	OpenAssignments int    `json:"openAssignments"`
+	AssignedHours   int    `json:"assignedHours"`
+	AvailableFrom   string `json:"availableFrom,omitempty"`
+}
+
+func CreateTeam(c fiber.Ctx) error {
+	team := new(models.Team)
+	if err := json.Unmarshal(c.Body(), &team); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	if msg := validateTeam(db(c), team); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+	// members are managed through /team/member
+	team.Members = nil
+	team.Children = nil
+	db(c).Create(&team)
+	return c.Status(fiber.StatusCreated).JSON(team)
+}
+
+// GetTeam returns the team with its members and the whole tree of teams
+// below it
+func GetTeam(c fiber.Ctx) error {
+	team := new(models.Team)
+	if err := json.Unmarshal(c.Body(), &team); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var existingTeam models.Team
+	db(c).First(&existingTeam, team.ID)
+	if existingTeam.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Team not found"})
+	}
+	if !canViewTeam(c, existingTeam.ID) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You can only view your own teams"})
+	}
+	loadTeam(db(c), &existingTeam)
+	return c.JSON(existingTeam)
+}
+
+func UpdateTeam(c fiber.Ctx) error {
+	team := new(models.Team)
+	if err := json.Unmarshal(c.Body(), &team); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var existingTeam models.Team
+	db(c).First(&existingTeam, team.ID)
+	if existingTeam.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Team not found"})
+	}
+	if msg := validateTeam(db(c), team); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+	if team.ParentID != nil && isTeamDescendant(db(c), existingTeam.ID, *team.ParentID) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "a team can't be moved below itself"})
+	}
+
+	db(c).Model(&existingTeam).Updates(map[string]interface{}{
+		"name":      team.Name,
+		"parent_id": team.ParentID,
+		"lead":      team.Lead,
+	})
+	return c.JSON(existingTeam)
+}
+
+func DeleteTeam(c fiber.Ctx) error {
+	team := new(models.Team)
+	if err := json.Unmarshal(c.Body(), &team); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var existingTeam models.Team
+	db(c).First(&existingTeam, team.ID)
+	if existingTeam.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Team not found"})
+	}
+	var childCount int64
+	db(c).Model(&models.Team{}).Where("parent_id = ?", existingTeam.ID).Count(&childCount)
+	if childCount != 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Team has sub-teams, move or delete them first"})
+	}
+
+	db(c).Where("team_id = ?", existingTeam.ID).Delete(&models.TeamMember{})
+	db(c).Delete(&existingTeam)
+	return c.JSON(fiber.Map{
+		"message": "Team deleted successfully",
+	})
+}
+
+func AddTeamMember(c fiber.Ctx) error {
+	member := new(models.TeamMember)
+	if err := json.Unmarshal(c.Body(), &member); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var existingTeam models.Team
+	db(c).First(&existingTeam, member.TeamID)
+	if existingTeam.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Team not found"})
+	}
+	var existingUser models.User
+	db(c).First(&existingUser, "username = ?", member.Username)
+	if len(existingUser.Username) == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Username doesn't exists"})
+	}
+
+	var existingMember models.TeamMember
+	db(c).First(&existingMember, "team_id = ? AND username = ?", member.TeamID, member.Username)
+	if existingMember.ID != 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "User is already a member of this team"})
+	}
+
+	member.ID = 0
+	db(c).Create(&member)
+	return c.Status(fiber.StatusCreated).JSON(member)
+}
+
+func RemoveTeamMember(c fiber.Ctx) error {
+	member := new(models.TeamMember)
+	if err := json.Unmarshal(c.Body(), &member); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var existingMember models.TeamMember
+	db(c).First(&existingMember, "team_id = ? AND username = ?", member.TeamID, member.Username)
+	if existingMember.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Team member not found"})
+	}
+	db(c).Delete(&existingMember)
+	return c.JSON(fiber.Map{
+		"message": "Team member removed successfully",
+	})
+}
+
+// GetTeamAssignments lists the assignments of everyone in the team and the
+// teams below it
+func GetTeamAssignments(c fiber.Ctx) error {
+	team := new(models.Team)
+	if err := json.Unmarshal(c.Body(), &team); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var existingTeam models.Team
+	db(c).First(&existingTeam, team.ID)
+	if existingTeam.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Team not found"})
+	}
+	if !canViewTeam(c, existingTeam.ID) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You can only view your own teams"})
+	}
+
+	var assignments []models.TaskAssignment
+	db(c).Where("username IN ?", teamUsernames(db(c), existingTeam.ID)).Order("id").Find(&assignments)
+	return c.JSON(assignments)
+}
+
+// GetTeamWorkload reports open assignments, assigned hours and availability
+// for everyone in the team and the teams below it
+func GetTeamWorkload(c fiber.Ctx) error {
+	team := new(models.Team)
+	if err := json.Unmarshal(c.Body(), &team); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var existingTeam models.Team
+	db(c).First(&existingTeam, team.ID)
+	if existingTeam.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Team not found"})
+	}
+	if !canViewTeam(c, existingTeam.ID) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You can only view your own teams"})
+	}
+
+	usernames := teamUsernames(db(c), existingTeam.ID)
+	workload := make(map[string]*MemberWorkload, len(usernames))
+	for _, username := range usernames {
+		workload[username] = &MemberWorkload{Username: username}
+	}
+
+	var open []struct {
+		Username       string
+		EndDate        string
+		EstimatedHours int
+	}
+	db(c).Model(&models.TaskAssignment{}).
+		Select("task_assignments.username, task_assignments.end_date, tasks.estimated_hours").
+		Joins("JOIN tasks ON tasks.id = task_assignments.task_id").
+		Where("task_assignments.username IN ? AND tasks.status <> ?", usernames, TaskStatusCompleted).
+		Scan(&open)
+
+	availableFrom := map[string]time.Time{}
+	for _, assignment := range open {
+		w := workload[assignment.Username]
+		w.OpenAssignments++
+		w.AssignedHours += assignment.EstimatedHours
+		end, err := time.Parse("2006-01-02 3:04 PM", assignment.EndDate)
+		if err == nil && end.After(availableFrom[assignment.Username]) {
+			availableFrom[assignment.Username] = end
+		}
+	}
+
+	result := make([]MemberWorkload, 0, len(workload))
+	for _, w := range workload {
+		if end, ok := availableFrom[w.Username]; ok {
+			w.AvailableFrom = end.Format("2006-01-02 3:04 PM")
+		}
+		result = append(result, *w)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Username < result[j].Username })
+	return c.JSON(result)
+}
+
+func validateTeam(tx *gorm.DB, team *models.Team) string {
+	if team.Name == "" {
+		return "name is required"
+	}
+	if team.ParentID != nil {
+		var parent models.Team
+		tx.First(&parent, *team.ParentID)
+		if parent.ID == 0 {
+			return "parent team not found"
+		}
+	}
+	if team.Lead != "" {
+		var lead models.User
+		tx.First(&lead, "username = ?", team.Lead)
+		if len(lead.Username) == 0 {
+			return "lead doesn't exist"
+		}
+	}
+	return ""
+}
+
+func loadTeam(tx *gorm.DB, team *models.Team) {
+	tx.Where("team_id = ?", team.ID).Order("username").Find(&team.Members)
+	tx.Where("parent_id = ?", team.ID).Order("id").Find(&team.Children)
+	for i := range team.Children {
+		loadTeam(tx, &team.Children[i])
+	}
+}
+
+// isTeamDescendant reports whether candidate sits somewhere below team,
+// which would make a cycle if team were moved under it
+func isTeamDescendant(tx *gorm.DB, teamID, candidateID uint) bool {
+	for id := candidateID; id != 0; {
+		if id == teamID {
+			return true
+		}
+		var t models.Team
+		tx.First(&t, id)
+		if t.ParentID == nil {
+			return false
+		}
+		id = *t.ParentID
+	}
+	return false
+}
+
+// teamSubtree returns the given teams and every team below them
+func teamSubtree(tx *gorm.DB, roots []uint) []uint {
+	seen := map[uint]bool{}
+	var ids []uint
+	for level := roots; len(level) != 0; {
+		var next []uint
+		for _, id := range level {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+				next = append(next, id)
+			}
+		}
+		level = nil
+		if len(next) != 0 {
+			tx.Model(&models.Team{}).Where("parent_id IN ?", next).Pluck("id", &level)
+		}
+	}
+	return ids
+}
+
+// teamUsernames returns the members and leads of the team and the teams
+// below it
+func teamUsernames(tx *gorm.DB, teamID uint) []string {
+	ids := teamSubtree(tx, []uint{teamID})
+	var members, leads []string
+	tx.Model(&models.TeamMember{}).Where("team_id IN ?", ids).Distinct().Pluck("username", &members)
+	tx.Model(&models.Team{}).Where("id IN ? AND lead <> ''", ids).Distinct().Pluck("lead", &leads)
+
+	seen := map[string]bool{}
+	var usernames []string
+	for _, username := range append(members, leads...) {
+		if !seen[username] {
+			seen[username] = true
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames
+}
+
+// ledTeams returns the teams username leads and every team below them
+func ledTeams(tx *gorm.DB, username string) []uint {
+	var roots []uint
+	tx.Model(&models.Team{}).Where("lead = ?", username).Pluck("id", &roots)
+	return teamSubtree(tx, roots)
+}
+
+// canViewTeam lets admins see every team. Managers see the subtrees of the
+// teams they belong to, and leads the subtrees of the teams they lead.
+func canViewTeam(c fiber.Ctx, teamID uint) bool {
+	if user.HasRole(c, models.RoleAdmin) {
+		return true
+	}
+	caller, _ := c.Locals("username").(string)
+	visible := ledTeams(db(c), caller)
+	if user.HasRole(c, models.RoleManager) {
+		var memberOf []uint
+		db(c).Model(&models.TeamMember{}).Where("username = ?", caller).Pluck("team_id", &memberOf)
+		visible = append(visible, teamSubtree(db(c), memberOf)...)
+	}
+	for _, id := range visible {
+		if id == teamID {
+			return true
+		}
+	}
+	return false
+}
+
+// leadsTeamOf reports whether lead leads a team that username belongs to,
+// directly or through a sub-team, counting the leads of those sub-teams too
+func leadsTeamOf(tx *gorm.DB, lead, username string) bool {
+	teams := ledTeams(tx, lead)
+	if len(teams) == 0 {
+		return false
+	}
+	var count int64
+	tx.Model(&models.TeamMember{}).Where("team_id IN ? AND username = ?", teams, username).Count(&count)
+	if count != 0 {
+		return true
+	}
+	tx.Model(&models.Team{}).Where("id IN ? AND lead = ?", teams, username).Count(&count)
+	return count != 0
+}
@@ -0,0 +1,226 @@
+package routes
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/saran-crayonte/task/models"
+	"gorm.io/gorm"
+)
+
+type TaskEffort struct {
+	TaskID         uint    `json:"taskid"`
+	EstimatedHours int     `json:"estimatedHours"`
+	ActualHours    float64 `json:"actualHours"`
+	RemainingHours float64 `json:"remainingHours"`
+}
+
+func CreateTimeEntry(c fiber.Ctx) error {
+	username, ok := c.Locals("username").(string)
+	if !ok {
+		return fiber.ErrUnauthorized
+	}
+	timeEntry := new(models.TimeEntry)
+	if err := json.Unmarshal(c.Body(), &timeEntry); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	if timeEntry.Hours <= 0 || timeEntry.Hours > 24 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "hours must be between 0 and 24"})
+	}
+	if timeEntry.Date == "" {
+		timeEntry.Date = time.Now().Format("2006-01-02")
+	}
+	if _, err := time.Parse("2006-01-02", timeEntry.Date); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid date format"})
+	}
+
+	var existingTaskAssignment models.TaskAssignment
+	db(c).First(&existingTaskAssignment, timeEntry.TaskAssignmentID)
+	if existingTaskAssignment.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task Assignment not found"})
+	}
+	if existingTaskAssignment.Username != username {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Task is not assigned to you"})
+	}
+
+	newTimeEntry := models.TimeEntry{
+		TaskAssignmentID: existingTaskAssignment.ID,
+		Username:         username,
+		Date:             timeEntry.Date,
+		Hours:            timeEntry.Hours,
+		Note:             timeEntry.Note,
+	}
+	db(c).Create(&newTimeEntry)
+	return c.Status(fiber.StatusCreated).JSON(newTimeEntry)
+}
+
+func GetTimeEntries(c fiber.Ctx) error {
+	timeEntry := new(models.TimeEntry)
+	if err := json.Unmarshal(c.Body(), &timeEntry); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var existingTaskAssignment models.TaskAssignment
+	db(c).First(&existingTaskAssignment, timeEntry.TaskAssignmentID)
+	if existingTaskAssignment.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task Assignment not found"})
+	}
+
+	var timeEntries []models.TimeEntry
+	db(c).Where("task_assignment_id = ?", existingTaskAssignment.ID).Order("date, id").Find(&timeEntries)
+	return c.JSON(timeEntries)
+}
+
+func DeleteTimeEntry(c fiber.Ctx) error {
+	username, ok := c.Locals("username").(string)
+	if !ok {
+		return fiber.ErrUnauthorized
+	}
+	timeEntry := new(models.TimeEntry)
+	if err := json.Unmarshal(c.Body(), &timeEntry); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var existingTimeEntry models.TimeEntry
+	db(c).First(&existingTimeEntry, timeEntry.ID)
+	if existingTimeEntry.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Time entry not found"})
+	}
+	if existingTimeEntry.Username != username {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Only the owner can delete this time entry"})
+	}
+
+	db(c).Delete(&existingTimeEntry)
+	return c.JSON(fiber.Map{
+		"message": "Time entry deleted successfully",
+	})
+}
+
+func StartTimer(c fiber.Ctx) error {
+	username, ok := c.Locals("username").(string)
+	if !ok {
+		return fiber.ErrUnauthorized
+	}
+	timeEntry := new(models.TimeEntry)
+	if err := json.Unmarshal(c.Body(), &timeEntry); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+
+	var existingTaskAssignment models.TaskAssignment
+	db(c).First(&existingTaskAssignment, timeEntry.TaskAssignmentID)
+	if existingTaskAssignment.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task Assignment not found"})
+	}
+	if existingTaskAssignment.Username != username {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Task is not assigned to you"})
+	}
+
+	var running models.TimeEntry
+	db(c).Where("username = ? AND started_at IS NOT NULL AND ended_at IS NULL", username).First(&running)
+	if running.ID != 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "A timer is already running"})
+	}
+
+	now := time.Now()
+	newTimeEntry := models.TimeEntry{
+		TaskAssignmentID: existingTaskAssignment.ID,
+		Username:         username,
+		Date:             now.Format("2006-01-02"),
+		Note:             timeEntry.Note,
+		StartedAt:        &now,
+	}
+	db(c).Create(&newTimeEntry)
+	return c.Status(fiber.StatusCreated).JSON(newTimeEntry)
+}
+
+func StopTimer(c fiber.Ctx) error {
+	username, ok := c.Locals("username").(string)
+	if !ok {
+		return fiber.ErrUnauthorized
+	}
+
+	var running models.TimeEntry
+	db(c).Where("username = ? AND started_at IS NOT NULL AND ended_at IS NULL", username).First(&running)
+	if running.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "No timer is running"})
+	}
+
+	now := time.Now()
+	hours := math.Round(now.Sub(*running.StartedAt).Hours()*100) / 100
+	// the same bound as CreateTimeEntry; a timer forgotten over a weekend is
+	// thrown away and the time logged by hand
+	if hours > 24 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "the timer ran for more than 24 hours, delete it and log the time by hand"})
+	}
+	running.EndedAt = &now
+	running.Hours = hours
+	db(c).Save(&running)
+	return c.JSON(running)
+}
+
+func GetTaskEffort(c fiber.Ctx) error {
+	task := new(models.Task)
+	if err := json.Unmarshal(c.Body(), &task); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var existingTask models.Task
+	db(c).First(&existingTask, task.ID)
+	if existingTask.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task not found"})
+	}
+	return c.JSON(taskEffort(db(c), existingTask))
+}
+
+// RescheduleTaskAssignment recomputes End_Date from the hours that are still
+// left on the task, starting now
+func RescheduleTaskAssignment(c fiber.Ctx) error {
+	taskAssignment := new(models.TaskAssignment)
+	if err := json.Unmarshal(c.Body(), &taskAssignment); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var existingTaskAssignment models.TaskAssignment
+	db(c).First(&existingTaskAssignment, taskAssignment.ID)
+	if existingTaskAssignment.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task Assignment not found"})
+	}
+	var existingTask models.Task
+	db(c).First(&existingTask, existingTaskAssignment.TaskID)
+	if existingTask.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task not found"})
+	}
+
+	startDate, err := time.Parse("2006-01-02 3:04 PM", existingTaskAssignment.Start_Date)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid date time format"})
+	}
+	// assignment dates are stored as wall clock time, so compare in the same terms
+	now := time.Now()
+	from := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, time.UTC)
+	if from.Before(startDate) {
+		from = startDate
+	}
+
+	effort := taskEffort(db(c), existingTask)
+	result := calculateEndDate(db(c), from, int(math.Ceil(effort.RemainingHours)))
+	existingTaskAssignment.End_Date = result.Format("2006-01-02 3:04 PM")
+	db(c).Model(&existingTaskAssignment).Updates(bumped(map[string]interface{}{"end_date": existingTaskAssignment.End_Date}))
+	db(c).First(&existingTaskAssignment, existingTaskAssignment.ID)
+	setETag(c, existingTaskAssignment.Version)
+	return c.JSON(existingTaskAssignment)
+}
+
+func taskEffort(tx *gorm.DB, task models.Task) TaskEffort {
+	var actual float64
+	tx.Model(&models.TimeEntry{}).
+		Joins("JOIN task_assignments ON task_assignments.id = time_entries.task_assignment_id").
+		Where("task_assignments.task_id = ? AND task_assignments.deleted_at IS NULL", task.ID).
+		Select("COALESCE(SUM(time_entries.hours), 0)").
+		Scan(&actual)
+
+	return TaskEffort{
+		TaskID:         task.ID,
+		EstimatedHours: task.EstimatedHours,
+		ActualHours:    actual,
+		RemainingHours: math.Max(float64(task.EstimatedHours)-actual, 0),
+	}
+}
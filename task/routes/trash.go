@@ -0,0 +1,279 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/saran-crayonte/task/database"
+	"github.com/saran-crayonte/task/models"
+	"gorm.io/gorm"
+)
+
+// What happens to the assignments of a task when the task is deleted
+const (
+	AssignmentPolicyReject   = "reject"
+	AssignmentPolicyCascade  = "cascade"
+	AssignmentPolicyUnassign = "unassign"
+)
+
+// TaskAssignmentDeletePolicy is used when the delete request doesn't pass
+// ?assignments=
+var TaskAssignmentDeletePolicy = AssignmentPolicyReject
+
+// TrashRetention is how long deleted tasks, assignments and holidays stay
+// restorable before they are purged for good
+var TrashRetention = 30 * 24 * time.Hour
+
+// GetTrash lists the deleted rows that can still be restored. ?type= narrows
+// it down to task, taskAssignment or holiday.
+func GetTrash(c fiber.Ctx) error {
+	kind := c.Query("type")
+	if kind != "" && kind != "task" && kind != "taskAssignment" && kind != "holiday" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "type must be task, taskAssignment or holiday"})
+	}
+	trash := fiber.Map{}
+	if kind == "" || kind == "task" {
+		var tasks []models.Task
+		deleted(db(c)).Find(&tasks)
+		trash["tasks"] = tasks
+	}
+	if kind == "" || kind == "taskAssignment" {
+		var assignments []models.TaskAssignment
+		deleted(db(c)).Find(&assignments)
+		trash["taskAssignments"] = assignments
+	}
+	if kind == "" || kind == "holiday" {
+		var holidays []models.Holiday
+		deleted(db(c)).Find(&holidays)
+		trash["holidays"] = holidays
+	}
+	trash["retention"] = TrashRetention.String()
+	return c.JSON(trash)
+}
+
+// RestoreTask brings back a deleted task together with the subtasks and
+// assignments that were deleted along with it
+func RestoreTask(c fiber.Ctx) error {
+	task := new(models.Task)
+	if err := json.Unmarshal(c.Body(), &task); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var deletedTask models.Task
+	deleted(db(c)).First(&deletedTask, task.ID)
+	if deletedTask.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task not found in trash"})
+	}
+	if deletedTask.ParentID != nil {
+		var parent models.Task
+		db(c).First(&parent, *deletedTask.ParentID)
+		if parent.ID == 0 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Restore the parent task first"})
+		}
+	}
+
+	deletedAt := deletedTask.DeletedAt.Time
+	ids := []uint{deletedTask.ID}
+	for queue := ids; len(queue) != 0; {
+		var children []uint
+		db(c).Unscoped().Model(&models.Task{}).
+			Where("parent_id IN ? AND deleted_at = ?", queue, deletedAt).
+			Pluck("id", &children)
+		ids = append(ids, children...)
+		queue = children
+	}
+
+	err := db(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Model(&models.Task{}).Where("id IN ?", ids).Updates(bumped(map[string]interface{}{"deleted_at": nil})).Error; err != nil {
+			return err
+		}
+		err := tx.Unscoped().Model(&models.TaskAssignment{}).
+			Where("task_id IN ? AND deleted_at = ?", ids, deletedAt).
+			Updates(bumped(map[string]interface{}{"deleted_at": nil})).Error
+		if err != nil {
+			return err
+		}
+		if deletedTask.ParentID != nil {
+			return rollupTask(tx, *deletedTask.ParentID)
+		}
+		return nil
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error restoring task"})
+	}
+	return c.JSON(fiber.Map{
+		"message": "Task restored successfully",
+	})
+}
+
+// RestoreTaskAssignment brings back a deleted assignment. Its task has to be
+// live.
+func RestoreTaskAssignment(c fiber.Ctx) error {
+	taskAssignment := new(models.TaskAssignment)
+	if err := json.Unmarshal(c.Body(), &taskAssignment); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var deletedTaskAssignment models.TaskAssignment
+	deleted(db(c)).First(&deletedTaskAssignment, taskAssignment.ID)
+	if deletedTaskAssignment.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Task Assignment not found in trash"})
+	}
+	if !canAssign(c, deletedTaskAssignment.Username) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You can only change assignments of yourself or your team"})
+	}
+	var existingTask models.Task
+	db(c).First(&existingTask, deletedTaskAssignment.TaskID)
+	if existingTask.ID == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Restore the task first"})
+	}
+
+	var liveCount int64
+	db(c).Model(&models.TaskAssignment{}).Where("task_id = ?", existingTask.ID).Count(&liveCount)
+	if liveCount != 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Task is already assigned to somebody"})
+	}
+
+	if errors.Is(db(c).Unscoped().Model(&deletedTaskAssignment).Updates(bumped(map[string]interface{}{"deleted_at": nil})).Error, gorm.ErrDuplicatedKey) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Task is already assigned to somebody"})
+	}
+	recordActivity(c, deletedTaskAssignment.TaskID, ActivityAssignment, "", deletedTaskAssignment.Username)
+	return c.JSON(fiber.Map{
+		"message": "Task Assignment restored successfully",
+	})
+}
+
+// RestoreHoliday brings back a deleted holiday unless another one has been
+// defined on its date since
+func RestoreHoliday(c fiber.Ctx) error {
+	holiday := new(models.Holiday)
+	if err := json.Unmarshal(c.Body(), &holiday); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	var deletedHoliday models.Holiday
+	deleted(db(c)).First(&deletedHoliday, holiday.ID)
+	if deletedHoliday.ID == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Holiday not found in trash"})
+	}
+	var existingHoliday models.Holiday
+	db(c).Where("holiday_date = ?", deletedHoliday.HolidayDate).First(&existingHoliday)
+	if existingHoliday.ID != 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Another holiday is already defined on this date"})
+	}
+	db(c).Unscoped().Model(&deletedHoliday).Updates(bumped(map[string]interface{}{"deleted_at": nil}))
+	return c.JSON(fiber.Map{
+		"message": "Holiday restored successfully",
+	})
+}
+
+// PurgeTrash removes everything that has been in the workspace's trash for
+// longer than TrashRetention without waiting for the background purger
+func PurgeTrash(c fiber.Ctx) error {
+	purged, err := purgeTrash(db(c), time.Now().Add(-TrashRetention))
+	if err != nil {
+		log.Println("Error purging trash.", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "trash could not be purged"})
+	}
+	return c.JSON(fiber.Map{
+		"message": "Trash purged successfully",
+		"purged":  purged,
+	})
+}
+
+// RunTrashPurger purges expired trash of every workspace every interval
+// until the process exits
+func RunTrashPurger(interval time.Duration) {
+	for {
+		tx := database.For(database.WithActor(context.Background(), "system"))
+		purged, err := purgeTrash(tx, time.Now().Add(-TrashRetention))
+		if err != nil {
+			log.Println("Error purging trash.", err)
+		} else if purged != 0 {
+			log.Printf("Purged %d deleted rows", purged)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func deleted(tx *gorm.DB) *gorm.DB {
+	return tx.Unscoped().Where("deleted_at IS NOT NULL").Order("deleted_at DESC")
+}
+
+// purgeTrash hard-deletes the rows deleted before cutoff along with what
+// hangs off them, and returns how many trashed rows went. It all happens in
+// one transaction; the files of purged attachments are only removed once it
+// has been committed, since they can't be brought back.
+func purgeTrash(tx *gorm.DB, cutoff time.Time) (int, error) {
+	purged := 0
+	var attachments []models.Attachment
+	err := tx.Transaction(func(tx *gorm.DB) error {
+		var tasks []models.Task
+		if err := tx.Unscoped().Where("deleted_at < ?", cutoff).Find(&tasks).Error; err != nil {
+			return err
+		}
+		for _, task := range tasks {
+			var taskAttachments []models.Attachment
+			if err := tx.Where("task_id = ?", task.ID).Find(&taskAttachments).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("task_id = ?", task.ID).Delete(&models.Attachment{}).Error; err != nil {
+				return err
+			}
+			attachments = append(attachments, taskAttachments...)
+			if err := tx.Where("task_id = ?", task.ID).Delete(&models.Comment{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("task_id = ?", task.ID).Delete(&models.TaskActivity{}).Error; err != nil {
+				return err
+			}
+
+			var assignments []models.TaskAssignment
+			if err := tx.Unscoped().Where("task_id = ?", task.ID).Find(&assignments).Error; err != nil {
+				return err
+			}
+			for _, assignment := range assignments {
+				if err := purgeTaskAssignment(tx, assignment); err != nil {
+					return err
+				}
+			}
+			if err := tx.Unscoped().Delete(&task).Error; err != nil {
+				return err
+			}
+			purged++
+		}
+
+		var assignments []models.TaskAssignment
+		if err := tx.Unscoped().Where("deleted_at < ?", cutoff).Find(&assignments).Error; err != nil {
+			return err
+		}
+		for _, assignment := range assignments {
+			if err := purgeTaskAssignment(tx, assignment); err != nil {
+				return err
+			}
+			purged++
+		}
+
+		result := tx.Unscoped().Where("deleted_at < ?", cutoff).Delete(&models.Holiday{})
+		if result.Error != nil {
+			return result.Error
+		}
+		purged += int(result.RowsAffected)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, attachment := range attachments {
+		removeAttachmentFile(attachment)
+	}
+	return purged, nil
+}
+
+func purgeTaskAssignment(tx *gorm.DB, assignment models.TaskAssignment) error {
+	if err := tx.Where("task_assignment_id = ?", assignment.ID).Delete(&models.TimeEntry{}).Error; err != nil {
+		return err
+	}
+	return tx.Unscoped().Delete(&assignment).Error
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrNotFound = errors.New("storage: object not found")
+
+// Storage keeps uploaded files outside the database, addressed by key
+type Storage interface {
+	Save(key string, r io.Reader) (int64, error)
+	Open(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+// FileSystem stores every object as a file below Root
+type FileSystem struct {
+	Root string
+}
+
+func NewFileSystem(root string) *FileSystem {
+	return &FileSystem{Root: root}
+}
+
+func (fs *FileSystem) path(key string) (string, error) {
+	p := filepath.Join(fs.Root, filepath.FromSlash(key))
+	rel, err := filepath.Rel(fs.Root, p)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", errors.New("storage: invalid key")
+	}
+	return p, nil
+}
+
+func (fs *FileSystem) Save(key string, r io.Reader) (int64, error) {
+	p, err := fs.path(key)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return 0, err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(p)
+		return 0, err
+	}
+	return n, nil
+}
+
+func (fs *FileSystem) Open(key string) (io.ReadCloser, error) {
+	p, err := fs.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (fs *FileSystem) Delete(key string) error {
+	p, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
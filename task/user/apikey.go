@@ -0,0 +1,170 @@
+package user
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/saran-crayonte/task/database"
+	"github.com/saran-crayonte/task/models"
+)
+
+// apiKeyPrefix starts every API key so Authenticate can tell it from a JWT
+const apiKeyPrefix = "tsk_"
+
+var roleRank = map[string]int{
+	models.RoleViewer:  1,
+	models.RoleMember:  2,
+	models.RoleManager: 3,
+	models.RoleAdmin:   4,
+}
+
+func CreateAPIKey() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		username, ok := c.Locals("username").(string)
+		if !ok {
+			return fiber.ErrUnauthorized
+		}
+		if viaAPIKey(c) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "API keys can't manage API keys"})
+		}
+
+		var formData struct {
+			Name          string `json:"name"`
+			Scope         string `json:"scope"`
+			ExpiresInDays int    `json:"expiresInDays"`
+		}
+		if err := json.Unmarshal(c.Body(), &formData); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+		}
+		if formData.Name == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "name is required"})
+		}
+		if formData.Scope == "" {
+			formData.Scope = models.RoleViewer
+		}
+		if _, ok := roleRank[formData.Scope]; !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid scope"})
+		}
+		role, _ := c.Locals("role").(string)
+		if roleRank[formData.Scope] > roleRank[role] {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "scope can't exceed your own role"})
+		}
+		if formData.ExpiresInDays < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "expiresInDays must not be negative"})
+		}
+
+		secret, err := randomToken(32)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "key could not be created"})
+		}
+		key := apiKeyPrefix + secret
+
+		apiKey := models.APIKey{
+			Username: username,
+			Name:     formData.Name,
+			Prefix:   key[:len(apiKeyPrefix)+6],
+			KeyHash:  hashToken(key),
+			Scope:    formData.Scope,
+		}
+		if formData.ExpiresInDays > 0 {
+			expiresAt := time.Now().AddDate(0, 0, formData.ExpiresInDays)
+			apiKey.ExpiresAt = &expiresAt
+		}
+		db(c).Create(&apiKey)
+
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+			"message": "Store this key now, it won't be shown again",
+			"key":     key,
+			"apiKey":  apiKey,
+		})
+	}
+}
+
+func GetAPIKeys() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		username, ok := c.Locals("username").(string)
+		if !ok {
+			return fiber.ErrUnauthorized
+		}
+		var apiKeys []models.APIKey
+		db(c).Where("username = ?", username).Order("id").Find(&apiKeys)
+		return c.JSON(apiKeys)
+	}
+}
+
+func RevokeAPIKey() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		username, ok := c.Locals("username").(string)
+		if !ok {
+			return fiber.ErrUnauthorized
+		}
+		if viaAPIKey(c) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "API keys can't manage API keys"})
+		}
+
+		var formData models.APIKey
+		if err := json.Unmarshal(c.Body(), &formData); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+		}
+		var apiKey models.APIKey
+		db(c).First(&apiKey, "id = ? AND username = ?", formData.ID, username)
+		if apiKey.ID == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "API key not found"})
+		}
+		if apiKey.RevokedAt == nil {
+			db(c).Model(&apiKey).Update("revoked_at", time.Now())
+		}
+		return c.JSON(fiber.Map{
+			"message": "API key revoked successfully",
+		})
+	}
+}
+
+// authenticateAPIKey resolves an API key to its owner and the role the
+// request may act as. It returns a message when the key is not usable.
+func authenticateAPIKey(key string) (models.User, string, string) {
+	var apiKey models.APIKey
+	database.DB.First(&apiKey, "key_hash = ?", hashToken(key))
+	now := time.Now()
+	switch {
+	case apiKey.ID == 0:
+		return models.User{}, "", "Invalid API key."
+	case apiKey.RevokedAt != nil:
+		return models.User{}, "", "API key has been revoked."
+	case apiKey.ExpiresAt != nil && now.After(*apiKey.ExpiresAt):
+		return models.User{}, "", "API key has expired."
+	}
+
+	var user models.User
+	database.DB.First(&user, "username = ?", apiKey.Username)
+	if len(user.Username) == 0 {
+		return models.User{}, "", "Invalid API key."
+	}
+	if !user.Active {
+		return models.User{}, "", "Account is deactivated."
+	}
+	if RequireVerifiedEmail && !user.EmailVerified {
+		return models.User{}, "", "Email address is not verified."
+	}
+
+	database.DB.Model(&apiKey).Update("last_used_at", now)
+
+	// the key acts with whichever is lower, its scope or the owner's role
+	// today, so demoting the owner also limits their keys
+	role := apiKey.Scope
+	if roleRank[user.Role] < roleRank[role] {
+		role = user.Role
+	}
+	return user, role, ""
+}
+
+func isAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+func viaAPIKey(c fiber.Ctx) bool {
+	usedKey, _ := c.Locals("apiKey").(bool)
+	return usedKey
+}
@@ -0,0 +1,209 @@
+package user
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningKey is one entry of the JWT key ring. HS256 keys use Secret;
+// RS256 and ES256 keys are read from PEM files. A key without a private
+// key file can only verify tokens, which is how retired keys are kept
+// around until the tokens they signed have expired.
+type SigningKey struct {
+	ID             string `json:"kid"`
+	Algorithm      string `json:"alg"`
+	Secret         string `json:"secret,omitempty"`
+	PrivateKeyFile string `json:"privateKeyFile,omitempty"`
+	PublicKeyFile  string `json:"publicKeyFile,omitempty"`
+	Active         bool   `json:"active"`
+
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+var (
+	keysMu    sync.RWMutex
+	keys      map[string]*SigningKey
+	activeKey *SigningKey
+)
+
+// LoadSigningKeys configures the key ring from the environment.
+//
+// JWT_KEYS_FILE points to a JSON array of SigningKey; exactly one of them
+// must be active and is used to sign new tokens, the rest only verify.
+// Without it a single HS256 key is built from JWT_SECRET and JWT_KEY_ID.
+// If neither is set a random secret is generated, so tokens stop working
+// when the process restarts.
+func LoadSigningKeys() error {
+	if path := os.Getenv("JWT_KEYS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var ring []SigningKey
+		if err := json.Unmarshal(data, &ring); err != nil {
+			return fmt.Errorf("parsing %s: %w", path, err)
+		}
+		return SetSigningKeys(ring)
+	}
+
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		log.Println("JWT_SECRET is not set, using a random secret for this process.")
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		secret = string(b)
+	}
+	kid := os.Getenv("JWT_KEY_ID")
+	if kid == "" {
+		kid = "default"
+	}
+	return SetSigningKeys([]SigningKey{{ID: kid, Algorithm: "HS256", Secret: secret, Active: true}})
+}
+
+// SetSigningKeys replaces the key ring. Tokens signed by keys that are no
+// longer in the ring stop validating.
+func SetSigningKeys(ring []SigningKey) error {
+	parsed := make(map[string]*SigningKey, len(ring))
+	var active *SigningKey
+	for i := range ring {
+		key := ring[i]
+		if key.ID == "" {
+			return errors.New("signing key without kid")
+		}
+		if _, ok := parsed[key.ID]; ok {
+			return fmt.Errorf("duplicate signing key %q", key.ID)
+		}
+		if err := key.parse(); err != nil {
+			return fmt.Errorf("signing key %q: %w", key.ID, err)
+		}
+		if key.Active {
+			if active != nil {
+				return errors.New("more than one active signing key")
+			}
+			if key.signKey == nil {
+				return fmt.Errorf("active signing key %q has no private key", key.ID)
+			}
+			active = &key
+		}
+		parsed[key.ID] = &key
+	}
+	if active == nil {
+		return errors.New("no active signing key")
+	}
+
+	keysMu.Lock()
+	keys = parsed
+	activeKey = active
+	keysMu.Unlock()
+	return nil
+}
+
+func (k *SigningKey) parse() error {
+	switch k.Algorithm {
+	case "HS256":
+		if k.Secret == "" {
+			return errors.New("HS256 key without secret")
+		}
+		k.method = jwt.SigningMethodHS256
+		k.signKey = []byte(k.Secret)
+		k.verifyKey = []byte(k.Secret)
+		return nil
+
+	case "RS256":
+		k.method = jwt.SigningMethodRS256
+		if k.PrivateKeyFile != "" {
+			pem, err := os.ReadFile(k.PrivateKeyFile)
+			if err != nil {
+				return err
+			}
+			private, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+			if err != nil {
+				return err
+			}
+			k.signKey = private
+			k.verifyKey = &private.PublicKey
+		}
+		if k.PublicKeyFile != "" {
+			pem, err := os.ReadFile(k.PublicKeyFile)
+			if err != nil {
+				return err
+			}
+			public, err := jwt.ParseRSAPublicKeyFromPEM(pem)
+			if err != nil {
+				return err
+			}
+			k.verifyKey = public
+		}
+
+	case "ES256":
+		k.method = jwt.SigningMethodES256
+		if k.PrivateKeyFile != "" {
+			pem, err := os.ReadFile(k.PrivateKeyFile)
+			if err != nil {
+				return err
+			}
+			private, err := jwt.ParseECPrivateKeyFromPEM(pem)
+			if err != nil {
+				return err
+			}
+			k.signKey = private
+			k.verifyKey = &private.PublicKey
+		}
+		if k.PublicKeyFile != "" {
+			pem, err := os.ReadFile(k.PublicKeyFile)
+			if err != nil {
+				return err
+			}
+			public, err := jwt.ParseECPublicKeyFromPEM(pem)
+			if err != nil {
+				return err
+			}
+			k.verifyKey = public
+		}
+
+	default:
+		return fmt.Errorf("unsupported algorithm %q", k.Algorithm)
+	}
+
+	if k.verifyKey == nil {
+		return errors.New("no key file given")
+	}
+	return nil
+}
+
+func signingKey() (*SigningKey, error) {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	if activeKey == nil {
+		return nil, errors.New("signing keys are not loaded")
+	}
+	return activeKey, nil
+}
+
+// verificationKey is the jwt.Keyfunc used by ValidateToken. It picks the key
+// named by the kid header and refuses tokens signed with another algorithm.
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	keysMu.RLock()
+	key, ok := keys[kid]
+	keysMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+	return key.verifyKey, nil
+}
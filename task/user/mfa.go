@@ -0,0 +1,300 @@
+package user
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/saran-crayonte/task/database"
+	"github.com/saran-crayonte/task/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MFARequiredRoles lists the roles that only take effect once the user has
+// signed in with a second factor. Until then the user acts as a member.
+var MFARequiredRoles = []string{models.RoleAdmin, models.RoleManager}
+
+// MFAChallengeTTL is how long the second login step may take
+var MFAChallengeTTL = 5 * time.Minute
+
+const recoveryCodeCount = 10
+
+// mfaAudience marks the short-lived token handed out between the password
+// and the TOTP step; it is never accepted as an access token
+const mfaAudience = "mfa"
+
+type mfaClaims struct {
+	jwt.RegisteredClaims
+}
+
+func requiresMFA(role string) bool {
+	for _, r := range MFARequiredRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// EnrollMFA starts TOTP enrollment and returns the secret and the otpauth URI
+// to show as a QR code. MFA is not enforced until VerifyMFA succeeds.
+func EnrollMFA() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		username, ok := c.Locals("username").(string)
+		if !ok {
+			return fiber.ErrUnauthorized
+		}
+		var existingUser models.User
+		db(c).First(&existingUser, "username = ?", username)
+		if len(existingUser.Username) == 0 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Username doesn't exists"})
+		}
+		if existingUser.MFAEnabled {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "MFA is already enabled"})
+		}
+
+		secret, err := newTOTPSecret()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "secret could not be created"})
+		}
+		db(c).Model(&existingUser).Update("mfa_secret", secret)
+
+		return c.JSON(fiber.Map{
+			"secret":     secret,
+			"otpauthUri": totpURI(username, secret),
+		})
+	}
+}
+
+// VerifyMFA confirms enrollment with a code from the authenticator, turns MFA
+// on and returns the recovery codes. They are not shown again.
+func VerifyMFA() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		username, ok := c.Locals("username").(string)
+		if !ok {
+			return fiber.ErrUnauthorized
+		}
+		var formData struct {
+			Code string `json:"code"`
+		}
+		if err := json.Unmarshal(c.Body(), &formData); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+		}
+
+		var existingUser models.User
+		db(c).First(&existingUser, "username = ?", username)
+		if existingUser.MFASecret == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "MFA enrollment has not been started"})
+		}
+		if existingUser.MFAEnabled {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "MFA is already enabled"})
+		}
+		step, ok := verifyTOTP(existingUser.MFASecret, formData.Code, existingUser.MFALastStep)
+		if !ok {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid code"})
+		}
+
+		codes, err := newRecoveryCodes(username)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "recovery codes could not be created"})
+		}
+		db(c).Model(&existingUser).Updates(map[string]interface{}{
+			"mfa_enabled":   true,
+			"mfa_last_step": step,
+		})
+
+		return c.JSON(fiber.Map{
+			"message":       "MFA enabled, log in again to use it",
+			"recoveryCodes": codes,
+		})
+	}
+}
+
+// DisableMFA turns MFA off. It needs the password and a current code, or a
+// recovery code.
+func DisableMFA() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		username, ok := c.Locals("username").(string)
+		if !ok {
+			return fiber.ErrUnauthorized
+		}
+		var formData struct {
+			Password     string `json:"password"`
+			Code         string `json:"code"`
+			RecoveryCode string `json:"recoveryCode"`
+		}
+		if err := json.Unmarshal(c.Body(), &formData); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+		}
+
+		var existingUser models.User
+		db(c).First(&existingUser, "username = ?", username)
+		if !existingUser.MFAEnabled {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "MFA is not enabled"})
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(existingUser.Password), []byte(formData.Password)); err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Password doesnt match"})
+		}
+		if !checkSecondFactor(existingUser, formData.Code, formData.RecoveryCode) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid code"})
+		}
+
+		db(c).Model(&existingUser).Updates(map[string]interface{}{
+			"mfa_enabled":   false,
+			"mfa_secret":    "",
+			"mfa_last_step": 0,
+		})
+		db(c).Where("username = ?", username).Delete(&models.RecoveryCode{})
+
+		return c.JSON(fiber.Map{
+			"message": "MFA disabled",
+		})
+	}
+}
+
+// LoginMFA is the second login step for users with MFA enabled. It takes the
+// mfaToken returned by Login and a TOTP or recovery code.
+func LoginMFA() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		returnObject := fiber.Map{
+			"status": "",
+			"msg":    "Something went wrong.",
+		}
+
+		var formData struct {
+			MFAToken     string `json:"mfaToken"`
+			Code         string `json:"code"`
+			RecoveryCode string `json:"recoveryCode"`
+		}
+		if err := json.Unmarshal(c.Body(), &formData); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+		}
+
+		username, err := validateMFAChallenge(formData.MFAToken)
+		if err != nil {
+			returnObject["msg"] = "Invalid or expired MFA token."
+			return c.Status(fiber.StatusUnauthorized).JSON(returnObject)
+		}
+
+		// the same keys as Login, so codes guessed across many accounts
+		// from one address are throttled too
+		userKey := userThrottleKey(username)
+		ipKey := ipThrottleKey(c.IP())
+		wait := throttleWait(userKey)
+		if ipWait := throttleWait(ipKey); ipWait > wait {
+			wait = ipWait
+		}
+		if wait > 0 {
+			returnObject["msg"] = "Too many failed attempts, try again later."
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			return c.Status(fiber.StatusTooManyRequests).JSON(returnObject)
+		}
+
+		var user models.User
+		db(c).First(&user, "username = ?", username)
+		if !user.MFAEnabled || !checkSecondFactor(user, formData.Code, formData.RecoveryCode) {
+			recordLoginFailure(userKey, UserFreeAttempts, UserLockoutAttempts)
+			recordLoginFailure(ipKey, IPFreeAttempts, IPLockoutAttempts)
+			returnObject["msg"] = "Invalid code."
+			return c.Status(fiber.StatusUnauthorized).JSON(returnObject)
+		}
+		clearLoginFailures(userKey)
+
+		if !user.Active {
+			returnObject["msg"] = "Account is deactivated."
+			return c.Status(fiber.StatusForbidden).JSON(returnObject)
+		}
+		if RequireVerifiedEmail && !user.EmailVerified {
+			returnObject["msg"] = "Email address is not verified."
+			return c.Status(fiber.StatusForbidden).JSON(returnObject)
+		}
+
+		token, refreshToken, err := startSession(user, true)
+		if err != nil {
+			returnObject["msg"] = "Token creation error."
+			return c.Status(fiber.StatusUnauthorized).JSON(returnObject)
+		}
+
+		returnObject["token"] = token
+		returnObject["refreshToken"] = refreshToken
+		returnObject["user"] = NewProfile(user)
+		returnObject["status"] = "OK"
+		returnObject["msg"] = "User authenticated"
+		return c.Status(fiber.StatusAccepted).JSON(returnObject)
+	}
+}
+
+// checkSecondFactor accepts either a TOTP code or an unused recovery code and
+// consumes it
+func checkSecondFactor(user models.User, code, recoveryCode string) bool {
+	if recoveryCode != "" {
+		return useRecoveryCode(user.Username, recoveryCode)
+	}
+	step, ok := verifyTOTP(user.MFASecret, code, user.MFALastStep)
+	if !ok {
+		return false
+	}
+	// only one request can move last step forward, which stops a code from
+	// being used twice in parallel
+	result := database.DB.Model(&models.User{}).
+		Where("username = ? AND mfa_last_step < ?", user.Username, step).
+		Update("mfa_last_step", step)
+	return result.RowsAffected == 1
+}
+
+func newRecoveryCodes(username string) ([]string, error) {
+	database.DB.Where("username = ?", username).Delete(&models.RecoveryCode{})
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(b))
+		code = code[:8] + "-" + code[8:]
+		database.DB.Create(&models.RecoveryCode{Username: username, CodeHash: hashToken(code)})
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func useRecoveryCode(username, code string) bool {
+	code = strings.ToLower(strings.TrimSpace(code))
+	result := database.DB.Model(&models.RecoveryCode{}).
+		Where("username = ? AND code_hash = ? AND used_at IS NULL", username, hashToken(code)).
+		Update("used_at", time.Now())
+	return result.RowsAffected == 1
+}
+
+func generateMFAChallenge(user models.User) (string, error) {
+	key, err := signingKey()
+	if err != nil {
+		return "", err
+	}
+	claims := mfaClaims{jwt.RegisteredClaims{
+		Subject:   user.Username,
+		Audience:  jwt.ClaimStrings{mfaAudience},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(MFAChallengeTTL)),
+	}}
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.signKey)
+}
+
+func validateMFAChallenge(mfaToken string) (string, error) {
+	token, err := jwt.ParseWithClaims(mfaToken, &mfaClaims{}, verificationKey, jwt.WithAudience(mfaAudience))
+	if err != nil {
+		return "", err
+	}
+	claims, ok := token.Claims.(*mfaClaims)
+	if !ok || claims.Subject == "" {
+		return "", errors.New("invalid MFA token claims")
+	}
+	return claims.Subject, nil
+}
@@ -0,0 +1,319 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gofiber/fiber/v3"
+	"github.com/saran-crayonte/task/models"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+)
+
+// OIDCConfig describes the identity provider used for single sign-on.
+// SSO is off while Issuer is empty.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+var OIDC OIDCConfig
+
+// OIDCLoginTTL is how long the user has to finish logging in at the provider
+var OIDCLoginTTL = 10 * time.Minute
+
+var (
+	oidcMu       sync.Mutex
+	oidcProvider *oidc.Provider
+	oidcIssuer   string
+)
+
+// LoadOIDCConfig reads OIDC_ISSUER, OIDC_CLIENT_ID, OIDC_CLIENT_SECRET and
+// OIDC_REDIRECT_URL
+func LoadOIDCConfig() {
+	OIDC = OIDCConfig{
+		Issuer:       os.Getenv("OIDC_ISSUER"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+	}
+}
+
+// provider fetches the issuer's discovery document once and keeps it
+func provider(ctx context.Context) (*oidc.Provider, error) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if oidcProvider != nil && oidcIssuer == OIDC.Issuer {
+		return oidcProvider, nil
+	}
+	p, err := oidc.NewProvider(ctx, OIDC.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	oidcProvider, oidcIssuer = p, OIDC.Issuer
+	return p, nil
+}
+
+func oauthConfig(p *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     OIDC.ClientID,
+		ClientSecret: OIDC.ClientSecret,
+		RedirectURL:  OIDC.RedirectURL,
+		Endpoint:     p.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+}
+
+// OIDCLogin starts the authorization code flow with PKCE by redirecting to
+// the identity provider
+func OIDCLogin() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		if OIDC.Issuer == "" {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Single sign-on is not configured"})
+		}
+		p, err := provider(c.UserContext())
+		if err != nil {
+			log.Println("Error loading OIDC provider.", err)
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "Identity provider is unavailable"})
+		}
+
+		state, err := randomToken(24)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "login could not be started"})
+		}
+		nonce, err := randomToken(24)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "login could not be started"})
+		}
+		verifier := oauth2.GenerateVerifier()
+
+		db(c).Where("expires_at < ?", time.Now()).Delete(&models.OIDCLoginState{})
+		db(c).Create(&models.OIDCLoginState{
+			State:     state,
+			Nonce:     nonce,
+			Verifier:  verifier,
+			ExpiresAt: time.Now().Add(OIDCLoginTTL),
+		})
+
+		url := oauthConfig(p).AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+		return c.Redirect().To(url)
+	}
+}
+
+// OIDCCallback finishes the flow: it redeems the code, verifies the ID token,
+// finds or provisions the local user and starts a session, or hands out an
+// MFA challenge like Login when the user has MFA enabled
+func OIDCCallback() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		returnObject := fiber.Map{
+			"status": "",
+			"msg":    "Something went wrong.",
+		}
+		if OIDC.Issuer == "" {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Single sign-on is not configured"})
+		}
+		if errCode := c.Query("error"); errCode != "" {
+			returnObject["msg"] = "Identity provider refused the login: " + errCode
+			return c.Status(fiber.StatusUnauthorized).JSON(returnObject)
+		}
+
+		var loginState models.OIDCLoginState
+		db(c).First(&loginState, "state = ?", c.Query("state"))
+		if loginState.State == "" {
+			returnObject["msg"] = "Unknown login state."
+			return c.Status(fiber.StatusBadRequest).JSON(returnObject)
+		}
+		// states are single use
+		db(c).Delete(&loginState)
+		if time.Now().After(loginState.ExpiresAt) {
+			returnObject["msg"] = "Login took too long, start again."
+			return c.Status(fiber.StatusBadRequest).JSON(returnObject)
+		}
+
+		ctx := c.UserContext()
+		p, err := provider(ctx)
+		if err != nil {
+			log.Println("Error loading OIDC provider.", err)
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "Identity provider is unavailable"})
+		}
+
+		oauthToken, err := oauthConfig(p).Exchange(ctx, c.Query("code"), oauth2.VerifierOption(loginState.Verifier))
+		if err != nil {
+			log.Println("Error redeeming OIDC code.", err)
+			returnObject["msg"] = "Login could not be completed."
+			return c.Status(fiber.StatusUnauthorized).JSON(returnObject)
+		}
+		rawIDToken, ok := oauthToken.Extra("id_token").(string)
+		if !ok {
+			returnObject["msg"] = "Identity provider returned no ID token."
+			return c.Status(fiber.StatusUnauthorized).JSON(returnObject)
+		}
+		idToken, err := p.Verifier(&oidc.Config{ClientID: OIDC.ClientID}).Verify(ctx, rawIDToken)
+		if err != nil {
+			log.Println("Error verifying OIDC ID token.", err)
+			returnObject["msg"] = "Login could not be completed."
+			return c.Status(fiber.StatusUnauthorized).JSON(returnObject)
+		}
+		if idToken.Nonce != loginState.Nonce {
+			returnObject["msg"] = "Login could not be completed."
+			return c.Status(fiber.StatusUnauthorized).JSON(returnObject)
+		}
+
+		var identity oidcIdentity
+		if err := idToken.Claims(&identity); err != nil {
+			returnObject["msg"] = "Identity provider returned invalid claims."
+			return c.Status(fiber.StatusUnauthorized).JSON(returnObject)
+		}
+
+		user, err := linkOIDCUser(db(c), idToken.Issuer, idToken.Subject, identity)
+		if errors.Is(err, errNoWorkspace) {
+			returnObject["msg"] = errNoWorkspace.Message
+			return c.Status(errNoWorkspace.Code).JSON(returnObject)
+		}
+		if err != nil {
+			returnObject["msg"] = err.Error()
+			return c.Status(fiber.StatusConflict).JSON(returnObject)
+		}
+		if !user.Active {
+			returnObject["msg"] = "Account is deactivated."
+			return c.Status(fiber.StatusForbidden).JSON(returnObject)
+		}
+		if RequireVerifiedEmail && !user.EmailVerified {
+			returnObject["msg"] = "Email address is not verified."
+			return c.Status(fiber.StatusForbidden).JSON(returnObject)
+		}
+
+		// the provider only stands in for the password, so accounts with
+		// MFA still answer the TOTP step through LoginMFA
+		if user.MFAEnabled {
+			mfaToken, err := generateMFAChallenge(user)
+			if err != nil {
+				returnObject["msg"] = "Token creation error."
+				return c.Status(fiber.StatusUnauthorized).JSON(returnObject)
+			}
+			returnObject["mfaToken"] = mfaToken
+			returnObject["status"] = "MFA_REQUIRED"
+			returnObject["msg"] = "Enter the code from your authenticator app"
+			return c.Status(fiber.StatusAccepted).JSON(returnObject)
+		}
+
+		token, refreshToken, err := startSession(user, false)
+		if err != nil {
+			returnObject["msg"] = "Token creation error."
+			return c.Status(fiber.StatusUnauthorized).JSON(returnObject)
+		}
+
+		returnObject["token"] = token
+		returnObject["refreshToken"] = refreshToken
+		returnObject["user"] = NewProfile(user)
+		returnObject["status"] = "OK"
+		returnObject["msg"] = "User authenticated"
+		return c.Status(fiber.StatusAccepted).JSON(returnObject)
+	}
+}
+
+type oidcIdentity struct {
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// linkOIDCUser returns the local user for a provider identity. An identity
+// seen before maps to the same user; otherwise an existing account with the
+// same email is linked, and failing that a new account is created. Linking
+// needs both the provider and the account to have verified the address, or
+// anyone able to register it at the provider could take the account over.
+func linkOIDCUser(tx *gorm.DB, issuer, subject string, identity oidcIdentity) (models.User, error) {
+	var user models.User
+	tx.First(&user, "o_id_c_issuer = ? AND o_id_c_subject = ?", issuer, subject)
+	if len(user.Username) != 0 {
+		return user, nil
+	}
+
+	if identity.Email != "" && identity.EmailVerified {
+		tx.First(&user, "LOWER(email) = LOWER(?)", identity.Email)
+		if len(user.Username) != 0 {
+			if user.OIDCSubject != "" {
+				return models.User{}, errors.New("this account is linked to another identity")
+			}
+			if !user.EmailVerified {
+				return models.User{}, errors.New("an account with this email exists, verify its address before signing in with single sign-on")
+			}
+			if err := tx.Model(&user).Updates(models.User{OIDCIssuer: issuer, OIDCSubject: subject}).Error; err != nil {
+				return models.User{}, err
+			}
+			return user, nil
+		}
+	}
+
+	// new users join the default workspace like those who register there
+	if !identity.EmailVerified || !mayJoinDefaultWorkspace(identity.Email) {
+		return models.User{}, errNoWorkspace
+	}
+
+	username := identity.PreferredUsername
+	if username == "" {
+		username, _, _ = strings.Cut(identity.Email, "@")
+	}
+	if username == "" {
+		username = "sso-" + subject
+	}
+	username = availableUsername(tx, username)
+
+	// emails stay unique, so an address the provider can't vouch for and
+	// that another account already uses is not copied over
+	email := identity.Email
+	if email != "" && validateEmail(tx, email, username) != "" {
+		email = ""
+	}
+
+	// SSO users never log in with a password, so store one nobody knows
+	random, err := randomToken(32)
+	if err != nil {
+		return models.User{}, err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(random), bcrypt.DefaultCost)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	user = models.User{
+		Username: username,
+		Name:     identity.Name,
+		Email:    email,
+		Password: string(hashedPassword),
+		Role:     models.RoleMember,
+		Active:   true,
+		// the provider vouches for the address, so no link is mailed
+		EmailVerified: email != "" && identity.EmailVerified,
+		OIDCIssuer:    issuer,
+		OIDCSubject:   subject,
+	}
+	if err := tx.Create(&user).Error; err != nil {
+		return models.User{}, err
+	}
+	return user, nil
+}
+
+func availableUsername(tx *gorm.DB, base string) string {
+	username := base
+	for i := 2; ; i++ {
+		var count int64
+		tx.Model(&models.User{}).Where("username = ?", username).Count(&count)
+		if count == 0 {
+			return username
+		}
+		username = fmt.Sprintf("%s%d", base, i)
+	}
+}
@@ -0,0 +1,134 @@
+package user
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// PasswordPolicy is the strength a new password has to meet
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+var Policy = PasswordPolicy{
+	MinLength:    8,
+	RequireLower: true,
+	RequireDigit: true,
+}
+
+// breachedPasswords holds lower-cased passwords known from public breaches.
+// A handful of the most common ones are always rejected; LoadPasswordPolicy
+// adds the rest from a local list.
+var breachedPasswords = map[string]struct{}{
+	"password":   {},
+	"password1":  {},
+	"123456":     {},
+	"12345678":   {},
+	"123456789":  {},
+	"1234567890": {},
+	"qwerty":     {},
+	"qwerty123":  {},
+	"abc123":     {},
+	"111111":     {},
+	"iloveyou":   {},
+	"admin123":   {},
+	"welcome1":   {},
+	"letmein":    {},
+	"monkey123":  {},
+}
+
+// LoadPasswordPolicy reads PASSWORD_MIN_LENGTH, PASSWORD_REQUIRE_UPPER,
+// PASSWORD_REQUIRE_LOWER, PASSWORD_REQUIRE_DIGIT and PASSWORD_REQUIRE_SYMBOL,
+// and loads BREACHED_PASSWORDS_FILE (one password per line) when set
+func LoadPasswordPolicy() error {
+	if v := os.Getenv("PASSWORD_MIN_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		Policy.MinLength = n
+	}
+	flags := map[string]*bool{
+		"PASSWORD_REQUIRE_UPPER":  &Policy.RequireUpper,
+		"PASSWORD_REQUIRE_LOWER":  &Policy.RequireLower,
+		"PASSWORD_REQUIRE_DIGIT":  &Policy.RequireDigit,
+		"PASSWORD_REQUIRE_SYMBOL": &Policy.RequireSymbol,
+	}
+	for name, flag := range flags {
+		if v := os.Getenv(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			*flag = b
+		}
+	}
+
+	path := os.Getenv("BREACHED_PASSWORDS_FILE")
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			breachedPasswords[strings.ToLower(line)] = struct{}{}
+		}
+	}
+	return scanner.Err()
+}
+
+// ValidatePassword checks password against Policy and the breached list and
+// returns why it was rejected, or "" if it is acceptable
+func ValidatePassword(password, username string) string {
+	if len([]rune(password)) < Policy.MinLength {
+		return "password must be at least " + strconv.Itoa(Policy.MinLength) + " characters long"
+	}
+	// bcrypt ignores everything past 72 bytes
+	if len(password) > 72 {
+		return "password must be at most 72 bytes long"
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	switch {
+	case Policy.RequireUpper && !upper:
+		return "password must contain an upper case letter"
+	case Policy.RequireLower && !lower:
+		return "password must contain a lower case letter"
+	case Policy.RequireDigit && !digit:
+		return "password must contain a digit"
+	case Policy.RequireSymbol && !symbol:
+		return "password must contain a symbol"
+	}
+
+	if username != "" && strings.EqualFold(password, username) {
+		return "password must not be the username"
+	}
+	if _, ok := breachedPasswords[strings.ToLower(password)]; ok {
+		return "password has appeared in a data breach, choose another one"
+	}
+	return ""
+}
@@ -0,0 +1,119 @@
+package user
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/saran-crayonte/task/database"
+	"github.com/saran-crayonte/task/models"
+	"gorm.io/gorm"
+)
+
+// Profile is what the API shows of a user. Unlike models.User it never
+// carries the password hash or MFA secrets.
+type Profile struct {
+	Username      string `json:"username"`
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"emailVerified"`
+	Role          string `json:"role"`
+	MFAEnabled    bool   `json:"mfaEnabled"`
+	SSO           bool   `json:"sso"`
+	Active        bool   `json:"active"`
+	WorkspaceID   uint   `json:"workspaceId"`
+}
+
+func NewProfile(user models.User) Profile {
+	return Profile{
+		Username:      user.Username,
+		Name:          user.Name,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Role:          user.Role,
+		MFAEnabled:    user.MFAEnabled,
+		SSO:           user.OIDCSubject != "",
+		Active:        user.Active,
+		WorkspaceID:   user.WorkspaceID,
+	}
+}
+
+// GetProfile returns the authenticated user's profile
+func GetProfile() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		username, ok := c.Locals("username").(string)
+		if !ok {
+			return fiber.ErrUnauthorized
+		}
+		var existingUser models.User
+		db(c).First(&existingUser, "username = ?", username)
+		if len(existingUser.Username) == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Username doesn't exists"})
+		}
+		return c.JSON(NewProfile(existingUser))
+	}
+}
+
+// UpdateProfile edits the authenticated user's name and email. Fields left
+// out of the request keep their value.
+func UpdateProfile() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		username, ok := c.Locals("username").(string)
+		if !ok {
+			return fiber.ErrUnauthorized
+		}
+
+		var formData struct {
+			Name  *string `json:"name"`
+			Email *string `json:"email"`
+		}
+		if err := json.Unmarshal(c.Body(), &formData); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+		}
+
+		var existingUser models.User
+		db(c).First(&existingUser, "username = ?", username)
+		if len(existingUser.Username) == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Username doesn't exists"})
+		}
+
+		if formData.Name != nil {
+			if strings.TrimSpace(*formData.Name) == "" {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "name can't be empty"})
+			}
+			existingUser.Name = strings.TrimSpace(*formData.Name)
+		}
+		emailChanged := false
+		if formData.Email != nil {
+			email := strings.TrimSpace(*formData.Email)
+			if email != existingUser.Email {
+				if msg := validateEmail(database.DB, email, username); msg != "" {
+					return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": msg})
+				}
+				existingUser.Email = email
+				existingUser.EmailVerified = false
+				emailChanged = true
+			}
+		}
+
+		err := db(c).Model(&existingUser).Updates(map[string]interface{}{
+			"name":           existingUser.Name,
+			"email":          existingUser.Email,
+			"email_verified": existingUser.EmailVerified,
+		}).Error
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "this email is already in use"})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "profile could not be updated"})
+		}
+		if emailChanged {
+			if err := sendVerificationEmail(existingUser); err != nil {
+				log.Println("Error creating email verification.", err)
+			}
+		}
+		return c.JSON(NewProfile(existingUser))
+	}
+}
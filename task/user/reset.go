@@ -0,0 +1,125 @@
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/saran-crayonte/task/mailer"
+	"github.com/saran-crayonte/task/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Mail delivers account emails such as password reset links
+var Mail mailer.Mailer = mailer.NewSMTPFromEnv()
+
+// PasswordResetURL is the page the reset email links to; the token is
+// appended to it
+var PasswordResetURL = "http://localhost:8080/reset-password?token="
+
+// PasswordResetTTL is how long a reset link stays usable
+var PasswordResetTTL = time.Hour
+
+// RequestPasswordReset mails a reset link to the account matching the given
+// username or email. It answers the same way whether or not the account
+// exists so it can't be used to probe for accounts.
+func RequestPasswordReset() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		var formData models.User
+		if err := json.Unmarshal(c.Body(), &formData); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+		}
+
+		response := fiber.Map{
+			"message": "If the account exists, a reset link has been sent to its email address",
+		}
+
+		var user models.User
+		switch {
+		case formData.Username != "":
+			db(c).First(&user, "username = ?", formData.Username)
+		case formData.Email != "":
+			db(c).First(&user, "LOWER(email) = LOWER(?)", formData.Email)
+		default:
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "username or email is required"})
+		}
+		if len(user.Username) == 0 {
+			return c.Status(fiber.StatusAccepted).JSON(response)
+		}
+
+		// only the newest link works
+		db(c).Model(&models.PasswordReset{}).
+			Where("username = ? AND used_at IS NULL", user.Username).
+			Update("used_at", time.Now())
+
+		token, err := randomToken(32)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "reset token could not be created"})
+		}
+		db(c).Create(&models.PasswordReset{
+			Username:  user.Username,
+			TokenHash: hashToken(token),
+			ExpiresAt: time.Now().Add(PasswordResetTTL),
+		})
+
+		body := fmt.Sprintf("Hi %s,\n\nUse the link below to choose a new password. It expires in %s.\n\n%s%s\n\nIf you didn't ask for this, you can ignore this email.\n",
+			user.Name, PasswordResetTTL, PasswordResetURL, token)
+		// sent in the background so response time doesn't reveal the account
+		go func(to string) {
+			if err := Mail.Send(to, "Reset your password", body); err != nil {
+				log.Println("Error sending password reset email.", err)
+			}
+		}(user.Email)
+
+		return c.Status(fiber.StatusAccepted).JSON(response)
+	}
+}
+
+// ConfirmPasswordReset sets a new password using a token from the reset email
+// and logs the account out everywhere
+func ConfirmPasswordReset() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		var formData struct {
+			Token    string `json:"token"`
+			Password string `json:"password"`
+		}
+		if err := json.Unmarshal(c.Body(), &formData); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+		}
+
+		var reset models.PasswordReset
+		db(c).First(&reset, "token_hash = ?", hashToken(formData.Token))
+		if reset.ID == 0 || reset.UsedAt != nil || time.Now().After(reset.ExpiresAt) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Reset link is invalid or has expired"})
+		}
+
+		if msg := ValidatePassword(formData.Password, reset.Username); msg != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": msg})
+		}
+
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(formData.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "hashing failed"})
+		}
+
+		// mark the token used before touching the password so it can't be
+		// redeemed twice
+		result := db(c).Model(&models.PasswordReset{}).
+			Where("id = ? AND used_at IS NULL", reset.ID).
+			Update("used_at", time.Now())
+		if result.RowsAffected == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Reset link is invalid or has expired"})
+		}
+
+		db(c).Model(&models.User{}).Where("username = ?", reset.Username).Update("password", string(hashedPassword))
+		db(c).Model(&models.RefreshToken{}).
+			Where("username = ? AND revoked_at IS NULL", reset.Username).
+			Update("revoked_at", time.Now())
+
+		return c.JSON(fiber.Map{
+			"message": "Password updated successfully",
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/saran-crayonte/task/database"
+	"github.com/saran-crayonte/task/models"
+	"gorm.io/gorm"
+)
+
+// RefreshTokenTTL is how long a refresh token can be exchanged for a new pair
+var RefreshTokenTTL = 30 * 24 * time.Hour
+
+// startSession opens a new login session and returns its first access and
+// refresh tokens. mfaVerified tells whether the login passed a second factor.
+func startSession(user models.User, mfaVerified bool) (string, string, error) {
+	familyID, err := randomToken(16)
+	if err != nil {
+		return "", "", err
+	}
+	refreshToken, _, err := issueRefreshToken(user.Username, familyID, mfaVerified)
+	if err != nil {
+		return "", "", err
+	}
+	accessToken, err := generateAccessToken(user, familyID, mfaVerified)
+	if err != nil {
+		return "", "", err
+	}
+	return accessToken, refreshToken, nil
+}
+
+var errRefreshTokenReused = errors.New("refresh token already used")
+
+// rotateRefreshToken replaces current with a new refresh token in the same
+// session and returns a fresh access token alongside it
+func rotateRefreshToken(user models.User, current models.RefreshToken) (string, string, error) {
+	// claim the token first so two concurrent refreshes can't both succeed
+	result := database.DB.Model(&models.RefreshToken{}).
+		Where("id = ? AND revoked_at IS NULL", current.ID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return "", "", result.Error
+	}
+	if result.RowsAffected == 0 {
+		return "", "", errRefreshTokenReused
+	}
+
+	refreshToken, next, err := issueRefreshToken(user.Username, current.FamilyID, current.MFAVerified)
+	if err != nil {
+		return "", "", err
+	}
+	database.DB.Model(&current).Update("replaced_by", next.ID)
+	accessToken, err := generateAccessToken(user, current.FamilyID, current.MFAVerified)
+	if err != nil {
+		return "", "", err
+	}
+	return accessToken, refreshToken, nil
+}
+
+func issueRefreshToken(username, familyID string, mfaVerified bool) (string, models.RefreshToken, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", models.RefreshToken{}, err
+	}
+	row := models.RefreshToken{
+		Username:    username,
+		FamilyID:    familyID,
+		TokenHash:   hashToken(token),
+		ExpiresAt:   time.Now().Add(RefreshTokenTTL),
+		MFAVerified: mfaVerified,
+	}
+	if err := database.DB.Create(&row).Error; err != nil {
+		return "", row, err
+	}
+	return token, row, nil
+}
+
+func revokeSession(familyID string) {
+	database.DB.Model(&models.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now())
+}
+
+// RevokeSessions logs username out everywhere. It runs in tx so callers can
+// make it part of a larger change.
+func RevokeSessions(tx *gorm.DB, username string) error {
+	return tx.Model(&models.RefreshToken{}).
+		Where("username = ? AND revoked_at IS NULL", username).
+		Update("revoked_at", time.Now()).Error
+}
+
+// sessionActive reports whether the session still has a refresh token that
+// can be used, i.e. nobody logged it out
+func sessionActive(familyID string) bool {
+	var count int64
+	database.DB.Model(&models.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL AND expires_at > ?", familyID, time.Now()).
+		Count(&count)
+	return count != 0
+}
+
+func randomToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is how refresh tokens are stored; they are high entropy, so a
+// plain SHA-256 is enough and allows lookups by hash
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
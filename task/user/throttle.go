@@ -0,0 +1,117 @@
+package user
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/saran-crayonte/task/database"
+	"github.com/saran-crayonte/task/models"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Limits for failed logins. After the free attempts every further attempt
+// has to wait twice as long as the previous one, up to MaxDelay. Reaching
+// the lockout threshold blocks the key for LockoutDuration. Failures older
+// than FailureWindow are forgotten. Addresses get more room than users since
+// many people can share one.
+var (
+	UserFreeAttempts    = 3
+	IPFreeAttempts      = 20
+	MaxDelay            = time.Minute
+	UserLockoutAttempts = 10
+	IPLockoutAttempts   = 50
+	LockoutDuration     = 15 * time.Minute
+	FailureWindow       = time.Hour
+)
+
+// dummyHash is compared against when the username doesn't exist so that a
+// login for an unknown account takes as long as a wrong password
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+func userThrottleKey(username string) string { return "user:" + username }
+func ipThrottleKey(ip string) string         { return "ip:" + ip }
+
+// throttleWait returns how long the key has to wait before it may try again
+func throttleWait(key string) time.Duration {
+	var throttle models.LoginThrottle
+	database.DB.First(&throttle, "key = ?", key)
+	if throttle.Key == "" {
+		return 0
+	}
+	now := time.Now()
+	if throttle.LockedUntil != nil && now.Before(*throttle.LockedUntil) {
+		return throttle.LockedUntil.Sub(now)
+	}
+	if now.Before(throttle.NextAttemptAt) {
+		return throttle.NextAttemptAt.Sub(now)
+	}
+	return 0
+}
+
+// recordLoginFailure counts a failed login against key. The counter goes up
+// in a single upsert that locks the row until the delay and lockout derived
+// from the new count are stored, so concurrent failures are all counted.
+func recordLoginFailure(key string, freeAttempts, lockoutAttempts int) {
+	now := time.Now()
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var failures int
+		err := tx.Raw(`INSERT INTO login_throttles (key, failures, last_failure_at, next_attempt_at)
+VALUES (?, 1, ?, ?)
+ON CONFLICT (key) DO UPDATE SET
+	failures = CASE WHEN login_throttles.last_failure_at < ? THEN 1 ELSE login_throttles.failures + 1 END,
+	last_failure_at = EXCLUDED.last_failure_at
+RETURNING failures`, key, now, now, now.Add(-FailureWindow)).Scan(&failures).Error
+		if err != nil {
+			return err
+		}
+
+		nextAttemptAt := now
+		if extra := failures - freeAttempts; extra > 0 {
+			delay := time.Duration(math.Min(float64(time.Second)*math.Pow(2, float64(extra-1)), float64(MaxDelay)))
+			nextAttemptAt = now.Add(delay)
+		}
+		var lockedUntil *time.Time
+		if failures >= lockoutAttempts {
+			until := now.Add(LockoutDuration)
+			lockedUntil = &until
+		}
+		return tx.Model(&models.LoginThrottle{}).Where("key = ?", key).Updates(map[string]interface{}{
+			"next_attempt_at": nextAttemptAt,
+			"locked_until":    lockedUntil,
+		}).Error
+	})
+	if err != nil {
+		log.Println("Error recording failed login.", err)
+	}
+}
+
+func clearLoginFailures(key string) {
+	database.DB.Delete(&models.LoginThrottle{}, "key = ?", key)
+}
+
+// UnlockUser clears the failed login counter of a user so they can log in
+// again right away
+func UnlockUser() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		var formData models.User
+		if err := json.Unmarshal(c.Body(), &formData); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+		}
+		if formData.Username == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "username is required"})
+		}
+		var existingUser models.User
+		db(c).First(&existingUser, "username = ?", formData.Username)
+		if len(existingUser.Username) == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Username doesn't exists"})
+		}
+		clearLoginFailures(userThrottleKey(formData.Username))
+		return c.JSON(fiber.Map{
+			"message": "User unlocked successfully",
+		})
+	}
+}
@@ -2,7 +2,12 @@ package user
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v3"
@@ -10,41 +15,156 @@ import (
 	"github.com/saran-crayonte/task/database"
 	"github.com/saran-crayonte/task/models"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// DefaultWorkspaceDomains are the email domains whose users may join the
+// default workspace on their own. Without REQUIRE_VERIFIED_EMAIL anybody can
+// claim an address at one of them, so set both.
+var DefaultWorkspaceDomains []string
+
+// errNoWorkspace turns away users who would join the default workspace
+// without an address at one of the DefaultWorkspaceDomains
+var errNoWorkspace = fiber.NewError(fiber.StatusForbidden, "name a new workspace, or ask an admin of an existing workspace to add you")
+
+// mayJoinDefaultWorkspace reports whether email is at one of the
+// DefaultWorkspaceDomains
+func mayJoinDefaultWorkspace(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	for _, domain := range DefaultWorkspaceDomains {
+		if strings.EqualFold(email[at+1:], domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Register creates an account. Naming a workspace that doesn't exist yet
+// creates it with the new user as its admin; without one the user joins the
+// default workspace, if their email is at one of the DefaultWorkspaceDomains.
+// Existing workspaces are joined through AddWorkspaceUser.
 func Register() fiber.Handler {
 	return func(c fiber.Ctx) error {
 		dat := new(models.User)
 		if err := json.Unmarshal(c.Body(), &dat); err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
 		}
+		var target struct {
+			Workspace string `json:"workspace"`
+		}
+		json.Unmarshal(c.Body(), &target)
 
-		// Check if username already exists
-		var existingUser models.User
-		database.DB.First(&existingUser, "username = ?", dat.Username)
-		if len(existingUser.Username) != 0 {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "this username already exists"})
+		if msg := validateNewUser(dat); msg != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": msg})
 		}
 
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(dat.Password), bcrypt.DefaultCost)
+		// the workspace only survives if its first user is created as well
+		var newUser models.User
+		err := db(c).Transaction(func(tx *gorm.DB) error {
+			workspaceID := uint(models.DefaultWorkspaceID)
+			if name := strings.TrimSpace(target.Workspace); name != "" {
+				workspaceTaken := fiber.NewError(fiber.StatusConflict, "this workspace already exists, ask one of its admins to add you")
+				var existingWorkspace models.Workspace
+				tx.First(&existingWorkspace, "name = ?", name)
+				if existingWorkspace.ID != 0 {
+					return workspaceTaken
+				}
+				newWorkspace := models.Workspace{Name: name}
+				if err := tx.Create(&newWorkspace).Error; err != nil {
+					if errors.Is(err, gorm.ErrDuplicatedKey) {
+						return workspaceTaken
+					}
+					return err
+				}
+				workspaceID = newWorkspace.ID
+			} else if !mayJoinDefaultWorkspace(dat.Email) {
+				return errNoWorkspace
+			}
+
+			var err error
+			newUser, err = createUser(tx, dat, workspaceID)
+			return err
+		})
 		if err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "hashing failed"})
+			return createUserError(c, err)
 		}
 
-		newUser := models.User{
-			Username: dat.Username,
-			Name:     dat.Name,
-			Email:    dat.Email,
-			Password: string(hashedPassword),
+		if err := sendVerificationEmail(newUser); err != nil {
+			log.Println("Error creating email verification.", err)
 		}
-		database.DB.Create(&newUser)
 
 		return c.Status(fiber.StatusCreated).JSON(fiber.Map{
-			"message": "User registered successfully",
+			"message": "User registered successfully, check your email to verify your address",
 		})
 	}
 }
 
+// validateNewUser checks the username, email and password of an account
+// about to be created
+func validateNewUser(dat *models.User) string {
+	// Check if username already exists
+	var existingUser models.User
+	database.DB.First(&existingUser, "username = ?", dat.Username)
+	if len(existingUser.Username) != 0 {
+		return "this username already exists"
+	}
+
+	dat.Email = strings.TrimSpace(dat.Email)
+	if msg := validateEmail(database.DB, dat.Email, dat.Username); msg != "" {
+		return msg
+	}
+	return ValidatePassword(dat.Password, dat.Username)
+}
+
+// createUser stores a new account. The caller mails the verification link
+// once the account is committed.
+func createUser(tx *gorm.DB, dat *models.User, workspaceID uint) (models.User, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(dat.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	// the first account of a workspace bootstraps it as its admin
+	role := models.RoleMember
+	var userCount int64
+	tx.Model(&models.User{}).Where("workspace_id = ?", workspaceID).Count(&userCount)
+	if userCount == 0 {
+		role = models.RoleAdmin
+	}
+
+	newUser := models.User{
+		Username:    dat.Username,
+		Name:        dat.Name,
+		Email:       dat.Email,
+		Password:    string(hashedPassword),
+		Role:        role,
+		Active:      true,
+		WorkspaceID: workspaceID,
+	}
+	if err := tx.Create(&newUser).Error; err != nil {
+		return models.User{}, err
+	}
+	return newUser, nil
+}
+
+// createUserError answers a failed createUser. A username or email that is
+// already taken is a conflict, anything else is on our side.
+func createUserError(c fiber.Ctx, err error) error {
+	var fiberErr *fiber.Error
+	switch {
+	case errors.As(err, &fiberErr):
+		return c.Status(fiberErr.Code).JSON(fiber.Map{"error": fiberErr.Message})
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "this username or email is already in use"})
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "user could not be created"})
+	}
+}
+
 func Login() fiber.Handler {
 	return func(c fiber.Ctx) error {
 		returnObject := fiber.Map{
@@ -62,28 +182,65 @@ func Login() fiber.Handler {
 		// log.Println("Form binding error.")
 		// return c.Status(fiber.StatusBadRequest).JSON(returnObject)
 
+		userKey := userThrottleKey(formData.Username)
+		ipKey := ipThrottleKey(c.IP())
+		wait := throttleWait(userKey)
+		if ipWait := throttleWait(ipKey); ipWait > wait {
+			wait = ipWait
+		}
+		if wait > 0 {
+			returnObject["msg"] = "Too many failed attempts, try again later."
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			return c.Status(fiber.StatusTooManyRequests).JSON(returnObject)
+		}
+
 		var user models.User
 
-		database.DB.First(&user, "username = ?", formData.Username)
-		if len(user.Username) == 0 {
-			returnObject["msg"] = "User not found."
+		db(c).First(&user, "username = ?", formData.Username)
 
-			return c.Status(fiber.StatusBadRequest).JSON(returnObject)
+		// Validate password. Unknown users are checked against a dummy hash
+		// and get the same answer as a wrong password.
+		hash := dummyHash
+		if len(user.Username) != 0 {
+			hash = []byte(user.Password)
 		}
+		err := bcrypt.CompareHashAndPassword(hash, []byte(formData.Password))
 
-		// Validate password
-		err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(formData.Password))
+		if err != nil || len(user.Username) == 0 {
+			recordLoginFailure(userKey, UserFreeAttempts, UserLockoutAttempts)
+			recordLoginFailure(ipKey, IPFreeAttempts, IPLockoutAttempts)
 
-		if err != nil {
-			//log.Println("Invalid password.")
-
-			returnObject["msg"] = "Password doesnt match"
+			returnObject["msg"] = "Invalid username or password."
 			return c.Status(fiber.StatusUnauthorized).JSON(returnObject)
 		}
+		clearLoginFailures(userKey)
+
+		if !user.Active {
+			returnObject["msg"] = "Account is deactivated."
+			return c.Status(fiber.StatusForbidden).JSON(returnObject)
+		}
+		if RequireVerifiedEmail && !user.EmailVerified {
+			returnObject["msg"] = "Email address is not verified."
+			return c.Status(fiber.StatusForbidden).JSON(returnObject)
+		}
+
+		// With MFA on, the password only earns a short-lived challenge that
+		// LoginMFA trades for the real tokens
+		if user.MFAEnabled {
+			mfaToken, err := generateMFAChallenge(user)
+			if err != nil {
+				returnObject["msg"] = "Token creation error."
+				return c.Status(fiber.StatusUnauthorized).JSON(returnObject)
+			}
+			returnObject["mfaToken"] = mfaToken
+			returnObject["status"] = "MFA_REQUIRED"
+			returnObject["msg"] = "Enter the code from your authenticator app"
+			return c.Status(fiber.StatusAccepted).JSON(returnObject)
+		}
 
 		// 2. Create token
 
-		token, err := GenerateToken(user)
+		token, refreshToken, err := startSession(user, false)
 
 		if err != nil {
 			returnObject["msg"] = "Token creation error."
@@ -91,13 +248,16 @@ func Login() fiber.Handler {
 		}
 
 		returnObject["token"] = token
-		returnObject["user"] = user
+		returnObject["refreshToken"] = refreshToken
+		returnObject["user"] = NewProfile(user)
 		returnObject["status"] = "OK"
 		returnObject["msg"] = "User authenticated"
 		return c.Status(fiber.StatusAccepted).JSON(returnObject)
 	}
 }
 
+// UpdatePassword changes the authenticated user's password after checking the
+// current one. Other sessions are logged out.
 func UpdatePassword() fiber.Handler {
 	return func(c fiber.Ctx) error {
 		// Get the username from the request context
@@ -107,29 +267,43 @@ func UpdatePassword() fiber.Handler {
 		}
 
 		// Parse request body
-		var user models.User
-		if err := json.Unmarshal(c.Body(), &user); err != nil {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+		var formData struct {
+			CurrentPassword string `json:"currentPassword"`
+			NewPassword     string `json:"newPassword"`
 		}
-		if username != user.Username {
-			return fiber.ErrUnauthorized
+		if err := json.Unmarshal(c.Body(), &formData); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
 		}
 
 		var existingUser models.User
-		database.DB.First(&existingUser, "username = ?", user.Username)
+		db(c).First(&existingUser, "username = ?", username)
 		if len(existingUser.Username) == 0 {
 			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Username doesn't exists"})
 		}
 
+		if err := bcrypt.CompareHashAndPassword([]byte(existingUser.Password), []byte(formData.CurrentPassword)); err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Current password doesnt match"})
+		}
+		if formData.NewPassword == formData.CurrentPassword {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "new password must be different from the current one"})
+		}
+		if msg := ValidatePassword(formData.NewPassword, username); msg != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": msg})
+		}
+
 		// Hash the new password
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(formData.NewPassword), bcrypt.DefaultCost)
 		if err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "hashing failed"})
 		}
 
 		// Update the user's password in the database
-		user.Password = string(hashedPassword)
-		database.DB.Model(&existingUser).Updates(user)
+		db(c).Model(&existingUser).Update("password", string(hashedPassword))
+
+		sessionID, _ := c.Locals("session").(string)
+		db(c).Model(&models.RefreshToken{}).
+			Where("username = ? AND family_id <> ? AND revoked_at IS NULL", username, sessionID).
+			Update("revoked_at", time.Now())
 
 		return c.JSON(fiber.Map{
 			"message": "Password updated successfully",
@@ -138,27 +312,52 @@ func UpdatePassword() fiber.Handler {
 }
 
 type CustomClaims struct {
-	Email    string
-	Username string
+	Email     string
+	Username  string
+	Role      string
+	SessionID string `json:",omitempty"`
+	// MFA is set when the session passed a second factor, not merely when
+	// the user has one enrolled
+	MFA bool `json:",omitempty"`
+	// WorkspaceID scopes every request made with the token; tokens issued
+	// before workspaces existed belong to the default one
+	WorkspaceID uint `json:",omitempty"`
 
 	jwt.RegisteredClaims
 }
 
-var secret string = "secret"
+// AccessTokenTTL is how long an access token is valid; clients renew it with
+// their refresh token
+var AccessTokenTTL = 15 * time.Minute
 
 func GenerateToken(user models.User) (string, error) {
+	return generateAccessToken(user, "", false)
+}
+
+func generateAccessToken(user models.User, sessionID string, mfaVerified bool) (string, error) {
 
 	claims := CustomClaims{
 		user.Email,
 		user.Username,
+		user.Role,
+		sessionID,
+		mfaVerified,
+		user.WorkspaceID,
 		jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Local().Add(time.Hour * 24)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Local().Add(AccessTokenTTL)),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	key, err := signingKey()
+	if err != nil {
+		log.Println("Error in token signing.", err)
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.ID
 
-	t, err := token.SignedString([]byte(secret))
+	t, err := token.SignedString(key.signKey)
 
 	if err != nil {
 		log.Println("Error in token signing.", err)
@@ -171,9 +370,7 @@ func GenerateToken(user models.User) (string, error) {
 
 // Validate Token
 func ValidateToken(clientToken string) (*CustomClaims, string) {
-	token, err := jwt.ParseWithClaims(clientToken, &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	})
+	token, err := jwt.ParseWithClaims(clientToken, &CustomClaims{}, verificationKey)
 
 	if err != nil {
 		return nil, err.Error()
@@ -181,76 +378,299 @@ func ValidateToken(clientToken string) (*CustomClaims, string) {
 
 	claims, ok := token.Claims.(*CustomClaims)
 
-	if !ok {
+	if !ok || claims.Username == "" {
 		return nil, "Invalid token claims"
 	}
 
+	for _, audience := range claims.Audience {
+		if audience == mfaAudience {
+			return nil, "MFA token can't be used as an access token"
+		}
+	}
+
 	return claims, ""
 }
 
+// Authenticate accepts the access token as "Authorization: Bearer <jwt>" or,
+// for older clients, in the "token" header. A personal API key can be sent
+// the same way or in "X-API-Key".
 func Authenticate() fiber.Handler {
 	return func(c fiber.Ctx) error {
-		token := c.Get("token")
+		token, ok := bearerToken(c)
+		if !ok {
+			return unauthorized(c, "invalid_request", "Authorization header must use the Bearer scheme.")
+		}
+		if token == "" {
+			token = c.Get("token")
+		}
 
 		if token == "" {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Token not present."})
+			token = c.Get("X-API-Key")
 		}
 
-		claims, msg := ValidateToken(token)
+		if token == "" {
+			return unauthorized(c, "", "Token not present.")
+		}
+
+		if isAPIKey(token) {
+			user, role, msg := authenticateAPIKey(token)
+			if msg != "" {
+				return unauthorized(c, "invalid_token", msg)
+			}
+			c.Locals("username", user.Username)
+			c.Locals("role", role)
+			c.Locals("apiKey", true)
+			setWorkspace(c, user.WorkspaceID)
+			c.SetUserContext(database.WithActor(c.UserContext(), user.Username))
+			return c.Next()
+		}
 
-		log.Println(claims)
+		claims, msg := ValidateToken(token)
 
 		if msg != "" {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": msg})
+			return unauthorized(c, "invalid_token", msg)
+		}
+
+		if claims.SessionID != "" && !sessionActive(claims.SessionID) {
+			return unauthorized(c, "invalid_token", "Session has been logged out.")
 		}
 
 		c.Locals("username", claims.Username)
+		c.Locals("session", claims.SessionID)
+		c.Locals("role", claims.Role)
+		setWorkspace(c, claims.WorkspaceID)
+		c.SetUserContext(database.WithActor(c.UserContext(), claims.Username))
+		if requiresMFA(claims.Role) && !claims.MFA {
+			c.Locals("role", models.RoleMember)
+			c.Locals("mfaRequired", true)
+		}
+
+		return c.Next()
+	}
+}
 
+// db is the database session of a request. It only sees the caller's
+// workspace and records the caller in the audit log.
+func db(c fiber.Ctx) *gorm.DB {
+	return database.For(c.UserContext())
+}
+
+// setWorkspace confines the database queries of the rest of the request to
+// the caller's workspace
+func setWorkspace(c fiber.Ctx, workspaceID uint) {
+	if workspaceID == 0 {
+		workspaceID = models.DefaultWorkspaceID
+	}
+	c.Locals("workspace", workspaceID)
+	c.SetUserContext(database.WithWorkspace(c.UserContext(), workspaceID))
+}
+
+// bearerToken returns the token from the Authorization header. ok is false
+// when the header is present but doesn't use the Bearer scheme.
+func bearerToken(c fiber.Ctx) (string, bool) {
+	header := c.Get(fiber.HeaderAuthorization)
+	if header == "" {
+		return "", true
+	}
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// unauthorized answers 401 with a WWW-Authenticate challenge as described in
+// RFC 6750. errorCode is left out when no credentials were sent at all.
+func unauthorized(c fiber.Ctx, errorCode, description string) error {
+	challenge := `Bearer realm="task"`
+	if errorCode != "" {
+		challenge += fmt.Sprintf(`, error="%s", error_description=%q`, errorCode, description)
+	}
+	c.Set(fiber.HeaderWWWAuthenticate, challenge)
+	return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": description})
+}
+
+// Authorize only lets the request through when the authenticated user holds
+// one of the given roles. It has to run after Authenticate.
+func Authorize(roles ...string) fiber.Handler {
+	return func(c fiber.Ctx) error {
+		if !HasRole(c, roles...) {
+			if mfaRequired, _ := c.Locals("mfaRequired").(bool); mfaRequired {
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Your role requires MFA, enable it and log in again"})
+			}
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You don't have permission to do this"})
+		}
 		return c.Next()
 	}
 }
 
+func HasRole(c fiber.Ctx, roles ...string) bool {
+	role, _ := c.Locals("role").(string)
+	for _, r := range roles {
+		if role == r {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateRole changes a user's role and ends their sessions, so the old role
+// doesn't outlive the change in access tokens. A workspace always keeps an
+// active admin, and admins can't demote themselves.
+func UpdateRole() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		var formData models.User
+		if err := json.Unmarshal(c.Body(), &formData); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+		}
+
+		switch formData.Role {
+		case models.RoleAdmin, models.RoleManager, models.RoleMember, models.RoleViewer:
+		default:
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid role"})
+		}
+
+		err := db(c).Transaction(func(tx *gorm.DB) error {
+			var existingUser models.User
+			tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&existingUser, "username = ?", formData.Username)
+			if len(existingUser.Username) == 0 {
+				return fiber.NewError(fiber.StatusNotFound, "Username doesn't exists")
+			}
+			if existingUser.Role == formData.Role {
+				return nil
+			}
+			if existingUser.Role == models.RoleAdmin {
+				if existingUser.Username == c.Locals("username") {
+					return fiber.NewError(fiber.StatusBadRequest, "You can't change your own role")
+				}
+				// the admins stay locked, so two demotions at once can't
+				// each leave the other as the last admin
+				var admins []string
+				err := tx.Model(&models.User{}).Clauses(clause.Locking{Strength: "UPDATE"}).
+					Where("role = ? AND active = ?", models.RoleAdmin, true).
+					Pluck("username", &admins).Error
+				if err != nil {
+					return err
+				}
+				if existingUser.Active && len(admins) <= 1 {
+					return fiber.NewError(fiber.StatusConflict, "The workspace needs at least one admin")
+				}
+			}
+
+			if err := tx.Model(&existingUser).Update("role", formData.Role).Error; err != nil {
+				return err
+			}
+			return RevokeSessions(tx, existingUser.Username)
+		})
+		var fiberErr *fiber.Error
+		if errors.As(err, &fiberErr) {
+			return c.Status(fiberErr.Code).JSON(fiber.Map{"error": fiberErr.Message})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "role could not be updated"})
+		}
+		return c.JSON(fiber.Map{
+			"message": "Role updated successfully",
+		})
+	}
+}
+
+// RefreshToken exchanges a refresh token for a new access and refresh token
+// pair. The presented token is revoked; presenting it again is treated as
+// theft and ends the whole session.
 func RefreshToken() fiber.Handler {
 	return func(c fiber.Ctx) error {
 		returnObject := fiber.Map{
-			"status": "OK",
-			"msg":    "Refresh Token route",
+			"status": "",
+			"msg":    "Something went wrong.",
 		}
 
-		username := c.Get("username")
-		if username == "" {
-			log.Println("Username key not found.")
+		var formData struct {
+			RefreshToken string `json:"refreshToken"`
+		}
+		if err := json.Unmarshal(c.Body(), &formData); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+		}
 
-			returnObject["msg"] = "username not found."
+		var current models.RefreshToken
+		db(c).First(&current, "token_hash = ?", hashToken(formData.RefreshToken))
+		if current.ID == 0 {
+			returnObject["msg"] = "Invalid refresh token."
+			return c.Status(fiber.StatusUnauthorized).JSON(returnObject)
+		}
+		if current.RevokedAt != nil {
+			if current.ReplacedBy != 0 {
+				log.Printf("Refresh token reuse detected for %s, revoking session.", current.Username)
+				revokeSession(current.FamilyID)
+			}
+			returnObject["msg"] = "Invalid refresh token."
+			return c.Status(fiber.StatusUnauthorized).JSON(returnObject)
+		}
+		if time.Now().After(current.ExpiresAt) {
+			returnObject["msg"] = "Refresh token expired."
 			return c.Status(fiber.StatusUnauthorized).JSON(returnObject)
 		}
-
-		// emailStr, ok := email.(string)
-		// if !ok {
-		// 	log.Println("Email is not of type string.")
-		// 	returnObject["msg"] = "Email is not valid."
-		// 	return c.Status(fiber.StatusBadRequest).JSON(returnObject)
-		// }
 
 		var user models.User
-		database.DB.First(&user, "username = ?", username)
-
+		db(c).First(&user, "username = ?", current.Username)
 		if len(user.Username) == 0 {
 			returnObject["msg"] = "Username not found."
-
-			return c.Status(fiber.StatusBadRequest).JSON(returnObject)
+			return c.Status(fiber.StatusUnauthorized).JSON(returnObject)
+		}
+		if !user.Active {
+			revokeSession(current.FamilyID)
+			returnObject["msg"] = "Account is deactivated."
+			return c.Status(fiber.StatusForbidden).JSON(returnObject)
+		}
+		if RequireVerifiedEmail && !user.EmailVerified {
+			returnObject["msg"] = "Email address is not verified."
+			return c.Status(fiber.StatusForbidden).JSON(returnObject)
 		}
 
-		token, err := GenerateToken(user)
-
+		accessToken, refreshToken, err := rotateRefreshToken(user, current)
+		if errors.Is(err, errRefreshTokenReused) {
+			log.Printf("Refresh token reuse detected for %s, revoking session.", current.Username)
+			revokeSession(current.FamilyID)
+			returnObject["msg"] = "Invalid refresh token."
+			return c.Status(fiber.StatusUnauthorized).JSON(returnObject)
+		}
 		if err != nil {
 			returnObject["msg"] = "Token creation error."
 			return c.Status(fiber.StatusUnauthorized).JSON(returnObject)
 		}
 
-		returnObject["token"] = token
-		returnObject["user"] = user
-
+		returnObject["token"] = accessToken
+		returnObject["refreshToken"] = refreshToken
+		returnObject["status"] = "OK"
+		returnObject["msg"] = "Token refreshed"
 		return c.JSON(returnObject)
 	}
 }
+
+// Logout ends the session the access token belongs to
+func Logout() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		sessionID, _ := c.Locals("session").(string)
+		if sessionID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Token is not bound to a session"})
+		}
+		revokeSession(sessionID)
+		return c.JSON(fiber.Map{
+			"message": "Logged out successfully",
+		})
+	}
+}
+
+// LogoutAll ends every session of the authenticated user
+func LogoutAll() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		username, ok := c.Locals("username").(string)
+		if !ok {
+			return fiber.ErrUnauthorized
+		}
+		RevokeSessions(database.DB, username)
+		return c.JSON(fiber.Map{
+			"message": "Logged out of all devices",
+		})
+	}
+}
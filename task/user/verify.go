@@ -0,0 +1,194 @@
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/mail"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/saran-crayonte/task/database"
+	"github.com/saran-crayonte/task/models"
+	"gorm.io/gorm"
+)
+
+// EmailVerificationURL is the page the verification email links to; the
+// token is appended to it
+var EmailVerificationURL = "http://localhost:8080/verify-email?token="
+
+// EmailVerificationTTL is how long a verification link stays usable
+var EmailVerificationTTL = 48 * time.Hour
+
+// RequireVerifiedEmail blocks login until the user has verified their email
+// address
+var RequireVerifiedEmail = false
+
+// validateEmail checks that email is a bare address and not used by another
+// account, and returns why it was rejected or "" if it is acceptable.
+// Addresses are unique across workspaces, so tx must not be confined to one.
+func validateEmail(tx *gorm.DB, email, username string) string {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || address.Name != "" {
+		return "invalid email address"
+	}
+	var count int64
+	tx.Model(&models.User{}).
+		Where("LOWER(email) = LOWER(?) AND username <> ?", email, username).
+		Count(&count)
+	if count != 0 {
+		return "this email is already in use"
+	}
+	return ""
+}
+
+// sendVerificationEmail mails a fresh verification link for the user's
+// current address. Older links stop working.
+func sendVerificationEmail(user models.User) error {
+	database.DB.Model(&models.EmailVerification{}).
+		Where("username = ? AND used_at IS NULL", user.Username).
+		Update("used_at", time.Now())
+
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	database.DB.Create(&models.EmailVerification{
+		Username:  user.Username,
+		Email:     user.Email,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(EmailVerificationTTL),
+	})
+
+	body := fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening the link below. It expires in %s.\n\n%s%s\n\nIf you didn't create an account, you can ignore this email.\n",
+		user.Name, EmailVerificationTTL, EmailVerificationURL, token)
+	go func(to string) {
+		if err := Mail.Send(to, "Confirm your email address", body); err != nil {
+			log.Println("Error sending verification email.", err)
+		}
+	}(user.Email)
+	return nil
+}
+
+// VerifyEmail marks the address as verified using a token from the
+// verification email
+func VerifyEmail() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		var formData struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(c.Body(), &formData); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+		}
+
+		var verification models.EmailVerification
+		db(c).First(&verification, "token_hash = ?", hashToken(formData.Token))
+		if verification.ID == 0 || verification.UsedAt != nil || time.Now().After(verification.ExpiresAt) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Verification link is invalid or has expired"})
+		}
+		result := db(c).Model(&models.EmailVerification{}).
+			Where("id = ? AND used_at IS NULL", verification.ID).
+			Update("used_at", time.Now())
+		if result.RowsAffected == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Verification link is invalid or has expired"})
+		}
+
+		// the link only vouches for the address it was sent to
+		result = db(c).Model(&models.User{}).
+			Where("username = ? AND email = ?", verification.Username, verification.Email).
+			Update("email_verified", true)
+		if result.RowsAffected == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Verification link is invalid or has expired"})
+		}
+
+		return c.JSON(fiber.Map{
+			"message": "Email verified successfully",
+		})
+	}
+}
+
+// ResendVerification mails a new verification link to the account matching
+// the given username or email. Like RequestPasswordReset it answers the same
+// way whether or not the account exists.
+func ResendVerification() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		var formData models.User
+		if err := json.Unmarshal(c.Body(), &formData); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+		}
+
+		response := fiber.Map{
+			"message": "If the account exists and is unverified, a verification link has been sent",
+		}
+
+		var user models.User
+		switch {
+		case formData.Username != "":
+			db(c).First(&user, "username = ?", formData.Username)
+		case formData.Email != "":
+			db(c).First(&user, "LOWER(email) = LOWER(?)", formData.Email)
+		default:
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "username or email is required"})
+		}
+		if len(user.Username) == 0 || user.EmailVerified {
+			return c.Status(fiber.StatusAccepted).JSON(response)
+		}
+
+		if err := sendVerificationEmail(user); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "verification token could not be created"})
+		}
+		return c.Status(fiber.StatusAccepted).JSON(response)
+	}
+}
+
+// AdminResendVerification lets an admin send a new verification link to a
+// user
+func AdminResendVerification() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		var formData models.User
+		if err := json.Unmarshal(c.Body(), &formData); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+		}
+
+		var existingUser models.User
+		db(c).First(&existingUser, "username = ?", formData.Username)
+		if len(existingUser.Username) == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Username doesn't exists"})
+		}
+		if existingUser.EmailVerified {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Email is already verified"})
+		}
+
+		if err := sendVerificationEmail(existingUser); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "verification token could not be created"})
+		}
+		return c.JSON(fiber.Map{
+			"message": "Verification email sent",
+		})
+	}
+}
+
+// ForceVerifyEmail lets an admin mark a user's address as verified without
+// the email round trip
+func ForceVerifyEmail() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		var formData models.User
+		if err := json.Unmarshal(c.Body(), &formData); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+		}
+
+		var existingUser models.User
+		db(c).First(&existingUser, "username = ?", formData.Username)
+		if len(existingUser.Username) == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Username doesn't exists"})
+		}
+
+		db(c).Model(&existingUser).Update("email_verified", true)
+		db(c).Model(&models.EmailVerification{}).
+			Where("username = ? AND used_at IS NULL", existingUser.Username).
+			Update("used_at", time.Now())
+		return c.JSON(fiber.Map{
+			"message": "Email verified successfully",
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package user
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/saran-crayonte/task/models"
+)
+
+// GetWorkspace returns the workspace the caller belongs to
+func GetWorkspace() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		workspaceID, _ := c.Locals("workspace").(uint)
+		var workspace models.Workspace
+		db(c).First(&workspace, workspaceID)
+		if workspace.ID == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Workspace not found"})
+		}
+		return c.JSON(workspace)
+	}
+}
+
+// AddWorkspaceUser lets an admin create an account in their own workspace.
+// It takes the same payload as Register.
+func AddWorkspaceUser() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		dat := new(models.User)
+		if err := json.Unmarshal(c.Body(), &dat); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+		}
+		if msg := validateNewUser(dat); msg != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": msg})
+		}
+
+		workspaceID, _ := c.Locals("workspace").(uint)
+		newUser, err := createUser(db(c), dat, workspaceID)
+		if err != nil {
+			return createUserError(c, err)
+		}
+		if err := sendVerificationEmail(newUser); err != nil {
+			log.Println("Error creating email verification.", err)
+		}
+		return c.Status(fiber.StatusCreated).JSON(NewProfile(newUser))
+	}
+}